@@ -0,0 +1,214 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/jonboulle/clockwork"
+)
+
+// backChannelLogoutEvent is the member of the `events` claim identifying a logout token.
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// LogoutToken holds the claims of a validated logout token (OIDC Back-Channel Logout 1.0 2.4).
+// At least one of `Subject` and `SessionID` is set.
+type LogoutToken struct {
+	Issuer    string      // Issuer of the token (`iss`).
+	Subject   string      // User whose sessions are ended (`sub`). Empty if not present.
+	SessionID string      // Session at the authorization server which is ended (`sid`). Empty if not present.
+	JWTID     string      // Unique identifier of the token (`jti`).
+	IssuedAt  time.Time   // Time the token was issued (`iat`).
+	Expiry    time.Time   // Expiry of the token (`exp`).
+	Claims    jose.Claims // All the claims of the token.
+}
+
+// Matches reports whether session `s` is ended by the logout.
+// The `sid` and `sub` claims of the session ID token must match the ones of the logout token, if set.
+func (t LogoutToken) Matches(s Session) bool {
+	if t.SessionID != "" && t.SessionID != s.Token.SessionID() {
+		return false
+	}
+	if t.Subject != "" && t.Subject != s.Token.Subject() {
+		return false
+	}
+	return true
+}
+
+// ValidateLogoutToken validates a logout token sent by the authorization server to the back-channel logout endpoint.
+// The signature is verified with the provider keys the same way as for the ID tokens and the token must be issued
+// by the provider for the client, not expired, contain the back-channel logout event and identify the user or the session.
+// Replayed tokens are not detected, `NewBackChannelLogoutHandler` does it.
+func (mc *client) ValidateLogoutToken(logoutToken string) (LogoutToken, error) {
+	return mc.ValidateLogoutTokenContext(context.Background(), logoutToken)
+}
+
+// ValidateLogoutTokenContext validates a logout token like `ValidateLogoutToken`.
+// Argument `ctx` is used for the requests fetching the provider keys.
+func (mc *client) ValidateLogoutTokenContext(ctx context.Context, logoutToken string) (LogoutToken, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return LogoutToken{}, err
+	}
+	return validateLogoutToken(ctx, logoutToken, s.keys, s.provider.Issuer.String(), mc.config.ClientID, mc.config.Clock)
+}
+
+func validateLogoutToken(ctx context.Context, logoutToken string, keys keySource, issuer, clientID string, clock clockwork.Clock) (LogoutToken, error) {
+	jwt, err := jose.ParseJWT(logoutToken)
+	if err != nil {
+		return LogoutToken{}, newError(ErrMalformedToken, err)
+	}
+	if err = verifySignature(ctx, jwt, keys); err != nil {
+		return LogoutToken{}, err
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return LogoutToken{}, newError(ErrMalformedToken, err)
+	}
+
+	if iss, _, _ := claims.StringClaim("iss"); iss != issuer {
+		return LogoutToken{}, newError(ErrInvalidIssuer, fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", issuer, iss))
+	}
+	if !hasAudience(claims, clientID) {
+		return LogoutToken{}, newError(ErrInvalidAudience, fmt.Errorf("invalid claim value: 'aud'. audience=%s not found", clientID))
+	}
+
+	iat, ok, err := claims.TimeClaim("iat")
+	if err != nil || !ok {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("missing or invalid claim: 'iat'"))
+	}
+	exp, ok, err := claims.TimeClaim("exp")
+	if err != nil || !ok {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("missing or invalid claim: 'exp'"))
+	}
+	if !clock.Now().Before(exp) {
+		return LogoutToken{}, newError(ErrTokenExpired, fmt.Errorf("token is expired, exp=%v", exp))
+	}
+
+	events, ok := claims["events"].(map[string]interface{})
+	if !ok {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("missing or invalid claim: 'events'"))
+	}
+	if _, ok = events[backChannelLogoutEvent].(map[string]interface{}); !ok {
+		return LogoutToken{}, newError(ErrInvalidToken, fmt.Errorf("missing event: %s", backChannelLogoutEvent))
+	}
+	// The nonce is prohibited, so an ID token can't be used as a logout token.
+	if _, ok = claims["nonce"]; ok {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("prohibited claim: 'nonce'"))
+	}
+
+	t := LogoutToken{
+		Issuer:   issuer,
+		IssuedAt: iat,
+		Expiry:   exp,
+		Claims:   claims,
+	}
+	t.Subject, _, _ = claims.StringClaim("sub")
+	t.SessionID, _, _ = claims.StringClaim("sid")
+	t.JWTID, _, _ = claims.StringClaim("jti")
+	if t.Subject == "" && t.SessionID == "" {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("missing claims: 'sub' and 'sid'"))
+	}
+	if t.JWTID == "" {
+		return LogoutToken{}, newError(ErrInvalidToken, errors.New("missing claim: 'jti'"))
+	}
+
+	return t, nil
+}
+
+// backChannelLogoutHandler is the back-channel logout endpoint returned by `NewBackChannelLogoutHandler`.
+type backChannelLogoutHandler struct {
+	client Client
+	logout func(ctx context.Context, t LogoutToken) error
+	clock  clockwork.Clock
+
+	mu   sync.Mutex
+	seen map[string]time.Time // Expiry of the received logout tokens by their `jti`.
+}
+
+// NewBackChannelLogoutHandler returns the back-channel logout endpoint of the client
+// (OIDC Back-Channel Logout 1.0). It validates the logout tokens posted by the authorization server
+// with `mc.ValidateLogoutTokenContext`, rejects the replayed ones and calls `logout` for the valid ones.
+// Function `logout` should end the sessions matching the token, e.g. with `MemorySessionStore.DeleteMatching`.
+// The received tokens are remembered in memory, so the replays are detected only by the same instance.
+func NewBackChannelLogoutHandler(mc Client, logout func(ctx context.Context, t LogoutToken) error) http.Handler {
+	return &backChannelLogoutHandler{
+		client: mc,
+		logout: logout,
+		clock:  clockwork.NewRealClock(),
+		seen:   map[string]time.Time{},
+	}
+}
+
+func (h *backChannelLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	logoutToken := r.PostFormValue("logout_token")
+	if logoutToken == "" {
+		writeLogoutError(w, http.StatusBadRequest, "Missing logout token")
+		return
+	}
+
+	t, err := h.client.ValidateLogoutTokenContext(r.Context(), logoutToken)
+	switch {
+	case errors.Is(err, ErrProviderUnavailable), errors.Is(err, ErrClientClosed):
+		writeLogoutError(w, http.StatusServiceUnavailable, "The logout token cannot be validated")
+		return
+	case err != nil:
+		writeLogoutError(w, http.StatusBadRequest, invalidTokenDescription("logout token", err))
+		return
+	}
+	if !h.firstUse(t) {
+		writeLogoutError(w, http.StatusBadRequest, "The logout token was already used")
+		return
+	}
+
+	if err = h.logout(r.Context(), t); err != nil {
+		// The authorization server may retry the logout with the same token.
+		h.mu.Lock()
+		delete(h.seen, t.JWTID)
+		h.mu.Unlock()
+		writeLogoutError(w, http.StatusBadRequest, "Logout failed")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// firstUse records the `jti` of `t` until the token expires and reports whether it wasn't recorded already.
+func (h *backChannelLogoutHandler) firstUse(t LogoutToken) bool {
+	now := h.clock.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for jti, exp := range h.seen {
+		if !now.Before(exp) {
+			delete(h.seen, jti)
+		}
+	}
+	if _, ok := h.seen[t.JWTID]; ok {
+		return false
+	}
+	h.seen[t.JWTID] = t.Expiry
+	return true
+}
+
+// writeLogoutError writes the error response of the back-channel logout endpoint (OIDC Back-Channel Logout 1.0 2.8).
+func writeLogoutError(w http.ResponseWriter, status int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             "invalid_request",
+		"error_description": description,
+	})
+}
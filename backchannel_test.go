@@ -0,0 +1,174 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestLogoutTokenClaims(clock clockwork.Clock) jose.Claims {
+	return jose.Claims{
+		"iss":    "https://example.com",
+		"aud":    "test-id",
+		"sub":    "test-sub",
+		"sid":    "test-sid",
+		"jti":    "test-jti",
+		"iat":    clock.Now().Unix(),
+		"exp":    clock.Now().Add(2 * time.Minute).Unix(),
+		"events": map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+	}
+}
+
+func TestValidateLogoutToken(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+
+	lt, err := validateLogoutToken(context.Background(), newTestAccessToken(t, k, newTestLogoutTokenClaims(clock)), keys, "https://example.com", "test-id", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt.Issuer != "https://example.com" || lt.Subject != "test-sub" || lt.SessionID != "test-sid" || lt.JWTID != "test-jti" || !lt.Expiry.Equal(clock.Now().Add(2*time.Minute).Truncate(time.Second)) {
+		t.Errorf("Wrong logout token %+v", lt)
+	}
+}
+
+func TestValidateLogoutTokenInvalid(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	other := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+
+	cases := []struct {
+		name   string
+		key    *key.PrivateKey
+		modify func(jose.Claims)
+		err    error
+	}{
+		{"other key", other, func(c jose.Claims) {}, ErrInvalidSignature},
+		{"wrong issuer", k, func(c jose.Claims) { c["iss"] = "https://other.example.com" }, ErrInvalidIssuer},
+		{"wrong audience", k, func(c jose.Claims) { c["aud"] = "other-id" }, ErrInvalidAudience},
+		{"expired", k, func(c jose.Claims) { c["exp"] = clock.Now().Unix() }, ErrTokenExpired},
+		{"no expiry", k, func(c jose.Claims) { delete(c, "exp") }, ErrInvalidToken},
+		{"no iat", k, func(c jose.Claims) { delete(c, "iat") }, ErrInvalidToken},
+		{"no events", k, func(c jose.Claims) { delete(c, "events") }, ErrInvalidToken},
+		{"other event", k, func(c jose.Claims) { c["events"] = jose.Claims{"http://example.com/event": jose.Claims{}} }, ErrInvalidToken},
+		{"nonce", k, func(c jose.Claims) { c["nonce"] = "test-nonce" }, ErrInvalidToken},
+		{"no sub and sid", k, func(c jose.Claims) { delete(c, "sub"); delete(c, "sid") }, ErrInvalidToken},
+		{"no jti", k, func(c jose.Claims) { delete(c, "jti") }, ErrInvalidToken},
+	}
+	for _, c := range cases {
+		claims := newTestLogoutTokenClaims(clock)
+		c.modify(claims)
+		raw := newTestAccessToken(t, c.key, claims)
+
+		if _, err := validateLogoutToken(context.Background(), raw, keys, "https://example.com", "test-id", clock); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestLogoutTokenMatches(t *testing.T) {
+	s := Session{Token: Token{Claims: jose.Claims{"sub": "test-sub", "sid": "test-sid"}}}
+	cases := []struct {
+		token   LogoutToken
+		matches bool
+	}{
+		{LogoutToken{Subject: "test-sub", SessionID: "test-sid"}, true},
+		{LogoutToken{Subject: "test-sub"}, true},
+		{LogoutToken{SessionID: "test-sid"}, true},
+		{LogoutToken{Subject: "test-sub", SessionID: "other-sid"}, false},
+		{LogoutToken{Subject: "other-sub"}, false},
+	}
+	for _, c := range cases {
+		if c.token.Matches(s) != c.matches {
+			t.Errorf("Matches(%+v) != %v", c.token, c.matches)
+		}
+	}
+}
+
+func postLogoutToken(h http.Handler, logoutToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/backchannel-logout", strings.NewReader(url.Values{"logout_token": {logoutToken}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestBackChannelLogoutHandler(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	mc := &testClient{ValidLogoutToken: LogoutToken{Subject: "test-sub", JWTID: "test-jti", Expiry: clock.Now().Add(time.Minute)}}
+	var logouts []LogoutToken
+	h := NewBackChannelLogoutHandler(mc, func(ctx context.Context, t LogoutToken) error {
+		logouts = append(logouts, t)
+		return nil
+	})
+	h.(*backChannelLogoutHandler).clock = clock
+
+	w := postLogoutToken(h, "test-token")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Wrong response %v %v", w.Code, w.Header())
+	}
+	if mc.LogoutToken != "test-token" || len(logouts) != 1 || logouts[0].Subject != "test-sub" {
+		t.Errorf("Wrong logout %v %+v", mc.LogoutToken, logouts)
+	}
+
+	// Replayed token
+	if w = postLogoutToken(h, "test-token"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for replayed token, got %v", w.Code)
+	}
+	if len(logouts) != 1 {
+		t.Error("Replayed token accepted")
+	}
+
+	// The jti is forgotten after the token expires.
+	clock.Advance(time.Minute)
+	postLogoutToken(h, "test-token")
+	if n := len(h.(*backChannelLogoutHandler).seen); n != 1 {
+		t.Errorf("Expired tokens not removed, %v left", n)
+	}
+}
+
+func TestBackChannelLogoutHandlerErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		token     string
+		err       error
+		logoutErr error
+		status    int
+	}{
+		{"GET", "GET", "test-token", nil, nil, http.StatusMethodNotAllowed},
+		{"no token", "POST", "", nil, nil, http.StatusBadRequest},
+		{"invalid token", "POST", "test-token", newError(ErrInvalidSignature, errors.New("test")), nil, http.StatusBadRequest},
+		{"provider unavailable", "POST", "test-token", newError(ErrProviderUnavailable, errors.New("test")), nil, http.StatusServiceUnavailable},
+		{"logout failed", "POST", "test-token", nil, errors.New("test"), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		mc := &testClient{Err: c.err, ValidLogoutToken: LogoutToken{JWTID: "test-jti", Expiry: time.Now().Add(time.Minute)}}
+		h := NewBackChannelLogoutHandler(mc, func(ctx context.Context, t LogoutToken) error {
+			return c.logoutErr
+		})
+
+		r := httptest.NewRequest(c.method, "/backchannel-logout", strings.NewReader(url.Values{"logout_token": {c.token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%v: wrong status %v", c.name, w.Code)
+		}
+		if c.logoutErr != nil && len(h.(*backChannelLogoutHandler).seen) != 0 {
+			t.Errorf("%v: token of failed logout remembered", c.name)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package maas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+// ErrCacheMiss is returned by `Cache.Get` when there is no value for the key.
+var ErrCacheMiss = errors.New("cache miss")
+
+// Cache stores the provider configuration and the public keys of the authorization server,
+// so they don't have to be fetched again on each start of the process.
+// The values are stored along with their expiry time and expired values are not used.
+type Cache interface {
+	// Get returns the value stored for `key` or `ErrCacheMiss` if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores `data` for `key`.
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// memoryCache is a `Cache` keeping the values in memory.
+type memoryCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+// NewMemoryCache creates a `Cache` keeping the values in memory.
+// It can be shared between the clients of the same process.
+func NewMemoryCache() Cache {
+	return &memoryCache{values: map[string][]byte{}}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.values[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = append([]byte{}, data...)
+	return nil
+}
+
+// fileCache is a `Cache` storing each value in a file in a directory.
+type fileCache struct {
+	dir string
+}
+
+// NewFileCache creates a `Cache` storing the values in files in directory `dir`.
+// The directory is created if it doesn't exist.
+func NewFileCache(dir string) Cache {
+	return &fileCache{dir: dir}
+}
+
+// path returns the path of the file storing the value for `key`.
+func (c *fileCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *fileCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put writes the value to a temporary file and renames it, so a concurrent Get never reads a partial value.
+func (c *fileCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(key))
+}
+
+// cacheEntry is the format of the values stored in a `Cache`.
+type cacheEntry struct {
+	ExpiresAt time.Time       `json:"expires_at"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// loadCached loads the value for `key` from `cache` into `v` and returns its expiry time.
+// It reports false if the value is missing, can't be loaded or has expired.
+func loadCached(ctx context.Context, cache Cache, key string, v interface{}, clock clockwork.Clock) (time.Time, bool) {
+	if cache == nil {
+		return time.Time{}, false
+	}
+	data, err := cache.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var e cacheEntry
+	if err = json.Unmarshal(data, &e); err != nil || !clock.Now().Before(e.ExpiresAt) {
+		return time.Time{}, false
+	}
+	if err = json.Unmarshal(e.Value, v); err != nil {
+		return time.Time{}, false
+	}
+	return e.ExpiresAt, true
+}
+
+// storeCached stores `v` for `key` in `cache` until `expiresAt`.
+// The cache is used on a best-effort basis, so failures are ignored.
+func storeCached(ctx context.Context, cache Cache, key string, v interface{}, expiresAt time.Time) {
+	if cache == nil {
+		return
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(cacheEntry{ExpiresAt: expiresAt, Value: value})
+	if err != nil {
+		return
+	}
+	cache.Put(ctx, key, data)
+}
+
+func providerCacheKey(discoveryURI string) string {
+	return "provider:" + discoveryURI
+}
+
+func keysCacheKey(endpoint string) string {
+	return "keys:" + endpoint
+}
+
+// loadProviderConfig returns the provider configuration for `discoveryURI` from `cache` if it is there and not expired.
+func loadProviderConfig(ctx context.Context, cache Cache, discoveryURI string, clock clockwork.Clock) (providerConfig, bool) {
+	var provider providerConfig
+	expiresAt, ok := loadCached(ctx, cache, providerCacheKey(discoveryURI), &provider, clock)
+	if !ok {
+		return providerConfig{}, false
+	}
+	provider.ExpiresAt = expiresAt
+	return provider, true
+}
+
+// storeProviderConfig stores the provider configuration for `discoveryURI` in `cache`.
+// If the authorization server doesn't specify its expiry, it is kept until the next scheduled sync.
+func storeProviderConfig(ctx context.Context, cache Cache, discoveryURI string, provider providerConfig, clock clockwork.Clock) {
+	expiresAt := provider.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = clock.Now().UTC().Add(oidc.MaximumProviderConfigSyncInterval)
+	}
+	storeCached(ctx, cache, providerCacheKey(discoveryURI), &provider, expiresAt)
+}
+
+// jwks is the JSON Web Key Set format (RFC 7517 5).
+type jwks struct {
+	Keys []jose.JWK `json:"keys"`
+}
+
+// loadPublicKeys returns the public keys from `endpoint` from `cache` if they are there and not expired.
+func loadPublicKeys(ctx context.Context, cache Cache, endpoint string, clock clockwork.Clock) (*key.PublicKeySet, bool) {
+	var ks jwks
+	expiresAt, ok := loadCached(ctx, cache, keysCacheKey(endpoint), &ks, clock)
+	if !ok || len(ks.Keys) == 0 {
+		return nil, false
+	}
+	return key.NewPublicKeySet(ks.Keys, expiresAt), true
+}
+
+// storePublicKeys stores the public keys from `endpoint` in `cache`.
+func storePublicKeys(ctx context.Context, cache Cache, endpoint string, pks *key.PublicKeySet) {
+	ks := struct {
+		Keys []key.PublicKey `json:"keys"`
+	}{pks.Keys()}
+	storeCached(ctx, cache, keysCacheKey(endpoint), ks, pks.ExpiresAt())
+}
@@ -0,0 +1,185 @@
+package maas
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+func testCache(t *testing.T, c Cache) {
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "test"); err != ErrCacheMiss {
+		t.Fatalf("Expected ErrCacheMiss, got %v", err)
+	}
+
+	for _, v := range []string{"value", "updated"} {
+		if err := c.Put(ctx, "test", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.Get(ctx, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte(v)) {
+			t.Errorf("Wrong value %q, expected %q", data, v)
+		}
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, NewMemoryCache())
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maas-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCache(t, NewFileCache(filepath.Join(dir, "cache")))
+}
+
+func TestProviderConfigCache(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	cache := NewMemoryCache()
+
+	p := newTestProvider(t)
+	defer p.Close()
+	provider, err := getProviderConfig(p.Client(), p.URL, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.ExpiresAt = clock.Now().Add(time.Hour)
+
+	if _, ok := loadProviderConfig(ctx, cache, p.URL, clock); ok {
+		t.Fatal("Provider config loaded from empty cache")
+	}
+	storeProviderConfig(ctx, cache, p.URL, provider, clock)
+
+	cached, ok := loadProviderConfig(ctx, cache, p.URL, clock)
+	if !ok {
+		t.Fatal("Provider config not cached")
+	}
+	if cached.Issuer.String() != provider.Issuer.String() || cached.KeysEndpoint.String() != provider.KeysEndpoint.String() || !cached.ExpiresAt.Equal(provider.ExpiresAt) {
+		t.Errorf("Wrong cached provider config %+v", cached)
+	}
+
+	clock.Advance(time.Hour)
+	if _, ok := loadProviderConfig(ctx, cache, p.URL, clock); ok {
+		t.Error("Expired provider config loaded")
+	}
+
+	provider.ExpiresAt = time.Time{}
+	storeProviderConfig(ctx, cache, p.URL, provider, clock)
+	cached, ok = loadProviderConfig(ctx, cache, p.URL, clock)
+	if !ok || !cached.ExpiresAt.Equal(clock.Now().Add(oidc.MaximumProviderConfigSyncInterval)) {
+		t.Errorf("Provider config without expiry not cached until next sync, got %v", cached.ExpiresAt)
+	}
+}
+
+func TestPublicKeysCache(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	cache := NewMemoryCache()
+	k := newTestPrivateKey(t)
+
+	storePublicKeys(ctx, cache, "http://example.com/keys", key.NewPublicKeySet([]jose.JWK{k.JWK()}, clock.Now().Add(time.Hour)))
+
+	ks, ok := loadPublicKeys(ctx, cache, "http://example.com/keys", clock)
+	if !ok {
+		t.Fatal("Keys not cached")
+	}
+	if ks.Key(k.ID()) == nil || !ks.ExpiresAt().Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("Wrong cached keys %+v", ks)
+	}
+	if _, ok := loadPublicKeys(ctx, cache, "http://example.com/other", clock); ok {
+		t.Error("Keys loaded for other endpoint")
+	}
+
+	clock.Advance(time.Hour)
+	if _, ok := loadPublicKeys(ctx, cache, "http://example.com/keys", clock); ok {
+		t.Error("Expired keys loaded")
+	}
+}
+
+// testBlockingCache is a `Cache` blocking the calls until `release` is closed.
+type testBlockingCache struct {
+	Cache
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (c *testBlockingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.called <- struct{}{}
+	<-c.release
+	return c.Cache.Get(ctx, key)
+}
+
+func TestRemoteKeySetCacheUnlocked(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	cache := &testBlockingCache{Cache: NewMemoryCache(), called: make(chan struct{}), release: make(chan struct{})}
+	storePublicKeys(ctx, cache.Cache, "http://example.com/keys", key.NewPublicKeySet([]jose.JWK{k.JWK()}, clock.Now().Add(time.Hour)))
+
+	s := newRemoteKeySet(&testDoer{}, "http://example.com/keys", clock, cache)
+	done := make(chan error)
+	go func() {
+		_, err := s.Keys(ctx, false)
+		done <- err
+	}()
+
+	<-cache.called
+	s.setEndpoint("http://example.com/keys")
+	close(cache.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewClientCache(t *testing.T) {
+	k := newTestPrivateKey(t)
+	p := newTestProvider(t, k)
+	defer p.Close()
+	cfg := newTestConfig(p)
+	cfg.Cache = NewMemoryCache()
+
+	idToken := newTestSignedJWT(t, k, jose.Claims{
+		"iss": p.URL,
+		"sub": "test",
+		"aud": cfg.ClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	mc, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mc.(*client).state.oidc.VerifyJWT(context.Background(), idToken); err != nil {
+		t.Fatal(err)
+	}
+	mc.Close()
+
+	// The provider config and the keys are loaded from the cache.
+	p.SetAvailable(false)
+	mc, err = NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	if err = mc.(*client).state.oidc.VerifyJWT(context.Background(), idToken); err != nil {
+		t.Error(err)
+	}
+}
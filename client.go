@@ -2,13 +2,17 @@ package maas
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
 	"github.com/coreos/go-oidc/oauth2"
 	"github.com/coreos/go-oidc/oidc"
 	"github.com/jonboulle/clockwork"
@@ -22,46 +26,103 @@ const (
 
 // Config is configuration struct for initializing a Client object with NewClient.
 type Config struct {
-	ClientID        string          // RP client ID at authorization server (`client_id` in OIDC 1.0). Required.
-	ClientSecret    string          // RP client secret at authorization server (`client_secret` in OIDC 1.0). Required.
-	RedirectURI     string          // URI for back redirection from authorization server to RP (`redirect_uri` in OIDC 1.0). Required.
-	DiscoveryURI    string          // DiscoveryURI is the discovery URL of the Miracl OIDC server, without the `.well-known/openid-configuration`
-	HTTPClient      *http.Client    // HTTP client to use for requests to authorization server. If left out, `http.DefaultClient` will be used
-	ProviderRetries int             // Number of retries to make while fetching provider configuration from discovery URI.
-	Clock           clockwork.Clock // A clock object. If left out, real clock will be used. Fake clock can be passed for testing.
-	Scope           []string        // Scope of the claim (`scope` in OIDC 1.0). If not set, functional default will be populated.
+	ClientID              string               // RP client ID at authorization server (`client_id` in OIDC 1.0). Required.
+	ClientSecret          string               // RP client secret at authorization server (`client_secret` in OIDC 1.0). Required.
+	RedirectURI           string               // URI for back redirection from authorization server to RP (`redirect_uri` in OIDC 1.0). Required.
+	DiscoveryURI          string               // DiscoveryURI is the discovery URL of the Miracl OIDC server, without the `.well-known/openid-configuration`
+	HTTPClient            *http.Client         // HTTP client to use for requests to authorization server. If left out, `http.DefaultClient` will be used
+	ProviderRetries       int                  // Number of retries to make while fetching provider configuration from discovery URI.
+	Clock                 clockwork.Clock      // A clock object. If left out, real clock will be used. Fake clock can be passed for testing.
+	Scope                 []string             // Scope of the claim (`scope` in OIDC 1.0). If not set, functional default will be populated.
+	DecryptionKey         *key.PrivateKey      // Private key for decrypting encrypted UserInfo responses. Required only if the client is registered for encrypted UserInfo.
+	RetryPolicy           *RetryPolicy         // Policy for retrying the requests to authorization server. If left out, only the discovery is retried, `ProviderRetries` times.
+	LazyInit              bool                 // If set, NewClient doesn't wait for the provider discovery, but retries it in the background until it succeeds. Until then, the discovery is attempted on every call.
+	Cache                 Cache                // Cache for the provider configuration and public keys of authorization server. If set, the client starts from the cached copies until they expire.
+	ProviderConfig        *oidc.ProviderConfig // Static provider configuration. If set, the provider discovery is not made. Can't be set along with `DiscoveryDocument`.
+	DiscoveryDocument     []byte               // Static provider discovery document, the JSON content of `.well-known/openid-configuration`. If set, the provider discovery is not made.
+	JWKS                  []byte               // Static JSON Web Key Set of authorization server. If set, the public keys are not fetched from the JWKS endpoint.
+	Audience              string               // Expected audience (`aud` claim) of the access tokens validated with `ValidateAccessToken`, the identifier of the resource server. Required for access token validation.
+	IntrospectionCacheTTL time.Duration        // If set, the active results of `Introspect` are cached in memory for this long, but never past the expiry of the token.
 }
 
 // client is a local implementation of `Client` interface.
 type client struct {
+	config       Config
+	discoveryURI string
+	hc           httpDoer           // HTTP client retrying the requests according to `RetryPolicy`.
+	cancel       context.CancelFunc // Cancels the background initialization. Nil if not initialized lazily.
+	keys         staticKeySet       // Public keys parsed from `JWKS`. Nil if they are fetched from the JWKS endpoint.
+
+	introspections *introspectionCache // Nil if the introspection results are not cached.
+
+	initSem chan struct{} // Serializes the attempts to load the provider configuration. Holds a value while one is made.
+	mu      sync.Mutex
+	state   *clientState // Nil until the provider configuration is loaded.
+	closed  bool
+}
+
+// clientState holds the clients initialized from the provider configuration.
+type clientState struct {
 	oidc     oidcClient
 	oauth    oauthClient
-	provider oidc.ProviderConfig
-	config   Config
+	userInfo *userInfoDecoder
+	keys     keySource
+	provider providerConfig
+	stop     chan struct{} // Stops the provider config syncer, if any.
 }
 
 // Client is the public interface for communicating with MAAS authorization server.
 type Client interface {
 	GetAuthRequestURL(state string) (u string, err error)
+	GetAuthRequestURLWithParams(state string, p AuthParams) (u string, err error)
+	GetAuthRequestURLWithParamsContext(ctx context.Context, state string, p AuthParams) (u string, err error)
 	ValidateAuth(code string) (string, jose.JWT, error)
+	ValidateAuthWithParams(code string, p AuthParams) (string, jose.JWT, error)
+	ValidateAuthToken(code string, p AuthParams) (Token, error)
+	ValidateAuthTokenContext(ctx context.Context, code string, p AuthParams) (Token, error)
+	RefreshTokens(t Token) (Token, error)
+	RefreshTokensContext(ctx context.Context, t Token) (Token, error)
 	GetUserInfo(accessToken string) (ui UserInfo, err error)
+	GetUserInfoContext(ctx context.Context, accessToken string) (ui UserInfo, err error)
+	GetUserInfoForToken(t Token) (ui UserInfo, err error)
+	GetUserInfoForTokenContext(ctx context.Context, t Token) (ui UserInfo, err error)
+	GetUserInfoClaims(t Token) (ui UserInfo, claims UserInfoClaims, err error)
+	GetUserInfoClaimsContext(ctx context.Context, t Token) (ui UserInfo, claims UserInfoClaims, err error)
+	ValidateAccessToken(accessToken string, scopes ...string) (AccessToken, error)
+	ValidateAccessTokenContext(ctx context.Context, accessToken string, scopes ...string) (AccessToken, error)
+	Introspect(token string) (Introspection, error)
+	IntrospectContext(ctx context.Context, token string) (Introspection, error)
+	RevokeToken(token, hint string) error
+	RevokeTokenContext(ctx context.Context, token, hint string) error
+	GetLogoutURL(idTokenHint, postLogoutRedirectURI, state string) (string, error)
+	GetLogoutURLContext(ctx context.Context, idTokenHint, postLogoutRedirectURI, state string) (string, error)
+	ValidateLogoutToken(logoutToken string) (LogoutToken, error)
+	ValidateLogoutTokenContext(ctx context.Context, logoutToken string) (LogoutToken, error)
+	ValidateFrontChannelLogout(iss, sid string) (FrontChannelLogout, error)
+	ValidateFrontChannelLogoutContext(ctx context.Context, iss, sid string) (FrontChannelLogout, error)
+	Ready() bool
+	Close() error
 }
 
-// UserInfo holds user information retrieved from UserInfo endpoint.
-type UserInfo struct {
-	UserID string `json:"sub"`
-	Email  string `json:"email"`
+// AuthParams holds optional parameters of the authorization request.
+// The RP has to keep them between the authorization request and the callback,
+// as the same values are required to validate the authorization.
+type AuthParams struct {
+	CodeVerifier string // PKCE code verifier (RFC 7636). If set, S256 code challenge is sent with the authorization request and the verifier with the token request.
+	Nonce        string // Value to associate the client session with the ID token (`nonce` in OIDC 1.0). If set, the `nonce` claim of the ID token must match it.
 }
 
 // oauthClient is a local interface used to abstract oauth2.Client capabilities for testing.
 type oauthClient interface {
 	AuthCodeURL(state, accessType, prompt string) (url string)
-	RequestToken(grantType, value string) (result oauth2.TokenResponse, err error)
+	RequestToken(ctx context.Context, grantType, value string, params url.Values) (result oauth2.TokenResponse, err error)
+	Introspect(ctx context.Context, token string) (Introspection, error)
+	RevokeToken(ctx context.Context, token, hint string) error
 }
 
-// oidcClient is a local interface used to abstract oidc.Client capabilities for testing.
+// oidcClient is a local interface used to abstract the ID token verification for testing.
 type oidcClient interface {
-	VerifyJWT(jose.JWT) error
+	VerifyJWT(ctx context.Context, jwt jose.JWT) error
 }
 
 // httpDoer is a local interface used to abstract http.Client capabilities for testing.
@@ -69,6 +130,16 @@ type httpDoer interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
+// contextDoer is a `httpDoer` binding all the requests to a context.
+type contextDoer struct {
+	ctx context.Context
+	h   httpDoer
+}
+
+func (d contextDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.h.Do(req.WithContext(d.ctx))
+}
+
 func populateDefaultConfig(cfg Config) Config {
 	if cfg.HTTPClient == nil {
 		cfg.HTTPClient = http.DefaultClient
@@ -86,70 +157,402 @@ func populateDefaultConfig(cfg Config) Config {
 // Normally you need to populate `ClientID`, `ClientSecret`
 // and `RedirectURI` fields in `mcfg` argument.
 func NewClient(mcfg Config) (mc Client, err error) {
-	discoveryURI := DiscoveryURI
+	return NewClientContext(context.Background(), mcfg)
+}
+
+// NewClientContext instantiates a new `Client` object like `NewClient`.
+// Argument `ctx` is used for the discovery requests; if it is canceled,
+// the retries are aborted and the context error is returned.
+func NewClientContext(ctx context.Context, mcfg Config) (mc Client, err error) {
+	c := &client{
+		config:       populateDefaultConfig(mcfg),
+		discoveryURI: DiscoveryURI,
+		initSem:      make(chan struct{}, 1),
+	}
 	if mcfg.DiscoveryURI != "" {
-		discoveryURI = mcfg.DiscoveryURI
+		c.discoveryURI = mcfg.DiscoveryURI
+	}
+	var policy RetryPolicy
+	if c.config.RetryPolicy != nil {
+		policy = *c.config.RetryPolicy
+	}
+	c.hc = newRetryDoer(c.config.HTTPClient, policy, c.config.Clock)
+	if c.config.IntrospectionCacheTTL > 0 {
+		c.introspections = newIntrospectionCache(c.config.IntrospectionCacheTTL, c.config.Clock)
+	}
+
+	if c.config.JWKS != nil {
+		if c.keys, err = parseJWKS(c.config.JWKS); err != nil {
+			return nil, err
+		}
+	}
+
+	provider, static, err := staticProviderConfig(c.config)
+	if err != nil {
+		return nil, err
+	}
+	if static {
+		if c.state, err = c.newState(provider, false); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if c.config.LazyInit {
+		bctx, cancel := context.WithCancel(context.Background())
+		c.cancel = cancel
+		go c.initBackground(bctx)
+		return c, nil
 	}
 
-	mcfg = populateDefaultConfig(mcfg)
+	provider, err = c.providerConfig(ctx, discoveryRetryPolicy(c.config))
+	if err != nil {
+		return nil, err
+	}
+	if c.state, err = c.newState(provider, true); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// staticProviderConfig returns the provider configuration set in `cfg`.
+// It reports false if the configuration has to be discovered.
+func staticProviderConfig(cfg Config) (provider providerConfig, ok bool, err error) {
+	switch {
+	case cfg.ProviderConfig != nil && cfg.DiscoveryDocument != nil:
+		return provider, false, errors.New("only one of ProviderConfig and DiscoveryDocument can be set")
+	case cfg.ProviderConfig != nil:
+		if err = cfg.ProviderConfig.Valid(); err != nil {
+			return provider, false, fmt.Errorf("invalid provider config: %v", err)
+		}
+		provider.ProviderConfig = *cfg.ProviderConfig
+		return provider, true, nil
+	case cfg.DiscoveryDocument != nil:
+		if err = json.Unmarshal(cfg.DiscoveryDocument, &provider); err != nil {
+			return provider, false, fmt.Errorf("invalid discovery document: %v", err)
+		}
+		return provider, true, nil
+	default:
+		return provider, false, nil
+	}
+}
 
-	var provider oidc.ProviderConfig
-	for tries := 0; true; {
+// providerConfig returns the provider configuration from the cache or,
+// if it is not cached, fetches it retrying according to `policy`.
+func (mc *client) providerConfig(ctx context.Context, policy RetryPolicy) (providerConfig, error) {
+	if provider, ok := loadProviderConfig(ctx, mc.config.Cache, mc.discoveryURI, mc.config.Clock); ok {
+		return provider, nil
+	}
+
+	provider, err := fetchProviderConfig(ctx, mc.config.HTTPClient, mc.discoveryURI, policy, mc.config.Clock)
+	if err != nil {
+		return provider, err
+	}
+	storeProviderConfig(ctx, mc.config.Cache, mc.discoveryURI, provider, mc.config.Clock)
+
+	return provider, nil
+}
 
-		provider, err = oidc.FetchProviderConfig(mcfg.HTTPClient, discoveryURI)
+// fetchProviderConfig fetches the provider configuration from `discoveryURI`.
+// The failures classified as retryable by `policy` are retried according to it.
+func fetchProviderConfig(ctx context.Context, h httpDoer, discoveryURI string, policy RetryPolicy, clock clockwork.Clock) (provider providerConfig, err error) {
+	start := clock.Now()
+	for n := 0; true; n++ {
+
+		rd := &recordingDoer{h: contextDoer{ctx, h}}
+		provider, err = getProviderConfig(rd, discoveryURI, clock)
 		if err == nil {
 			break
 		}
-		tries++
-		if tries > mcfg.ProviderRetries {
-			return nil, err
+		if ctx.Err() != nil {
+			return provider, ctx.Err()
+		}
+		// The request is not made at all if the discovery URI is invalid.
+		if rd.resp == nil && rd.err == nil || !policy.retryable(rd.resp, rd.err) {
+			return provider, newError(ErrProviderUnavailable, err)
+		}
+		delay := policy.delay(n)
+		if n >= policy.MaxRetries || (policy.MaxElapsedTime > 0 && clock.Now().Add(delay).Sub(start) > policy.MaxElapsedTime) {
+			return provider, newError(ErrProviderUnavailable, err)
 		}
 
-		mcfg.Clock.Sleep(sleepPeriod)
+		select {
+		case <-ctx.Done():
+			return provider, ctx.Err()
+		case <-clock.After(delay):
+		}
 	}
 
-	credentials := oidc.ClientCredentials{
-		ID:     mcfg.ClientID,
-		Secret: mcfg.ClientSecret,
+	return provider, nil
+}
+
+// newState initializes the clients for `provider`.
+// If `syncConfig` is set, the synchronization of the provider configuration is started.
+func (mc *client) newState(provider providerConfig, syncConfig bool) (*clientState, error) {
+	var keys keySource = mc.keys
+	var remoteKeys *remoteKeySet
+	if mc.keys == nil {
+		remoteKeys = newRemoteKeySet(mc.hc, provider.KeysEndpoint.String(), mc.config.Clock, mc.config.Cache)
+		keys = remoteKeys
 	}
 
-	oidc, err := oidc.NewClient(oidc.ClientConfig{
-		Credentials:    credentials,
-		RedirectURL:    mcfg.RedirectURI,
-		ProviderConfig: provider,
-		Scope:          mcfg.Scope,
-	})
+	s, err := mc.providerState(provider, keys)
 	if err != nil {
 		return nil, err
 	}
 
-	oidc.SyncProviderConfig(discoveryURI)
+	s.stop = make(chan struct{})
+	if syncConfig {
+		ps := &providerSync{
+			discoveryURI: mc.discoveryURI,
+			h:            mc.hc,
+			clock:        mc.config.Clock,
+			cache:        mc.config.Cache,
+			keys:         remoteKeys,
+			apply:        mc.applyProviderConfig,
+			initial:      &provider,
+		}
+		s.stop = oidc.NewProviderConfigSyncer(ps, ps).Run()
+	}
+
+	return s, nil
+}
+
+// providerState initializes the clients for `provider` verifying the tokens with `keys`.
+func (mc *client) providerState(provider providerConfig, keys keySource) (*clientState, error) {
+	credentials := oidc.ClientCredentials{
+		ID:     mc.config.ClientID,
+		Secret: mc.config.ClientSecret,
+	}
 
-	oauth, err := oidc.OAuthClient()
+	oauth, err := newOAuth2Client(mc.hc, credentials, mc.config.RedirectURI, mc.config.Scope, provider)
 	if err != nil {
 		return nil, err
 	}
 
-	return &client{
-		oidc:     oidc,
-		oauth:    oauth,
+	return &clientState{
+		oidc: &idTokenVerifier{
+			issuer:   provider.Issuer.String(),
+			clientID: mc.config.ClientID,
+			keys:     keys,
+			clock:    mc.config.Clock,
+		},
+		oauth: oauth,
+		userInfo: &userInfoDecoder{
+			issuer:        provider.Issuer.String(),
+			clientID:      mc.config.ClientID,
+			keys:          keys,
+			decryptionKey: mc.config.DecryptionKey,
+		},
+		keys:     keys,
 		provider: provider,
-		config:   mcfg,
-	}, err
+	}, nil
+}
+
+// applyProviderConfig replaces the clients with the ones initialized from the synced `provider`.
+// The key set and the running synchronization are kept.
+func (mc *client) applyProviderConfig(provider providerConfig) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.state == nil || mc.closed {
+		return nil
+	}
+	s, err := mc.providerState(provider, mc.state.keys)
+	if err != nil {
+		return err
+	}
+	s.stop = mc.state.stop
+	mc.state = s
+	return nil
+}
+
+// providerSync is the source and the destination of the provider config syncer.
+// The synced configuration is applied to the client and passed to the key set and the cache.
+type providerSync struct {
+	discoveryURI string
+	h            httpDoer
+	clock        clockwork.Clock
+	cache        Cache
+	keys         *remoteKeySet              // Nil if the keys are static.
+	apply        func(providerConfig) error // Applies the synced configuration to the client.
+	initial      *providerConfig            // Returned by the first Get, so the configuration is not fetched again right after it was loaded.
+	latest       providerConfig             // Returned by the last Get, including the metadata not held by oidc.ProviderConfig.
+	fetched      bool                       // Whether `latest` was fetched, rather than the configuration the client was initialized with.
+}
+
+// Get returns the provider configuration from the discovery URI.
+func (p *providerSync) Get() (oidc.ProviderConfig, error) {
+	if p.initial != nil {
+		p.latest = *p.initial
+		p.initial = nil
+		p.fetched = false
+		return p.latest.ProviderConfig, nil
+	}
+
+	provider, err := getProviderConfig(p.h, p.discoveryURI, p.clock)
+	if err != nil {
+		return oidc.ProviderConfig{}, err
+	}
+	p.latest = provider
+	p.fetched = true
+	return provider.ProviderConfig, nil
+}
+
+// Set applies the synced provider configuration to the client and passes it to the key set and the cache.
+// The syncer sets the configuration returned by Get, so the complete `latest` configuration is used.
+func (p *providerSync) Set(oidc.ProviderConfig) error {
+	if p.fetched && p.apply != nil {
+		if err := p.apply(p.latest); err != nil {
+			return err
+		}
+	}
+	if p.keys != nil {
+		p.keys.setEndpoint(p.latest.KeysEndpoint.String())
+	}
+	storeProviderConfig(context.Background(), p.cache, p.discoveryURI, p.latest, p.clock)
+	return nil
+}
+
+// getState returns the clients initialized from the provider configuration.
+// If the configuration is not loaded yet, a single attempt to load it is made.
+func (mc *client) getState(ctx context.Context) (*clientState, error) {
+	if s, err := mc.loadedState(); s != nil || err != nil {
+		return s, err
+	}
+
+	// Only one attempt at a time, the others wait for its result, unless `ctx` is done first.
+	select {
+	case mc.initSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-mc.initSem }()
+
+	if s, err := mc.loadedState(); s != nil || err != nil {
+		return s, err
+	}
+
+	provider, err := mc.providerConfig(ctx, RetryPolicy{})
+	if err != nil {
+		return nil, err
+	}
+	s, err := mc.newState(provider, true)
+	if err != nil {
+		return nil, err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.closed {
+		close(s.stop)
+		return nil, ErrClientClosed
+	}
+	mc.state = s
+	return s, nil
+}
+
+// loadedState returns the state if it is loaded or ErrClientClosed if the client is closed.
+func (mc *client) loadedState() (*clientState, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.state == nil && mc.closed {
+		return nil, ErrClientClosed
+	}
+	return mc.state, nil
+}
+
+// initBackground loads the provider configuration, retrying until it succeeds or `ctx` is canceled.
+// The delays between the attempts follow the discovery retry policy, but the number of attempts is not limited.
+func (mc *client) initBackground(ctx context.Context) {
+	policy := discoveryRetryPolicy(mc.config)
+	for n := 0; ; n++ {
+		if _, err := mc.getState(ctx); err == nil || ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-mc.config.Clock.After(policy.delay(n)):
+		}
+	}
+}
+
+// Ready reports whether the provider configuration has been loaded.
+// It is always true for clients not created with `LazyInit`.
+func (mc *client) Ready() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return mc.state != nil
+}
+
+// Close stops the background synchronization of the provider configuration
+// and the background initialization of a client created with `LazyInit`.
+// The client should not be used after it is closed. Calling Close more than once has no effect.
+func (mc *client) Close() error {
+	if mc.cancel != nil {
+		mc.cancel()
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.closed {
+		return nil
+	}
+	mc.closed = true
+	if mc.state != nil {
+		close(mc.state.stop)
+	}
+	return nil
 }
 
 // GetAuthRequestURL constructs redirect URL for authorization via M-Pin system.
 // Argument `state` is an opaque value set by the RP to maintain state between request and callback.
 func (mc *client) GetAuthRequestURL(state string) (string, error) {
-	return getAuthRequestURL(state, mc.oauth)
+	return mc.GetAuthRequestURLWithParams(state, AuthParams{})
 }
 
-func getAuthRequestURL(state string, oac oauthClient) (u string, err error) {
+// GetAuthRequestURLWithParams constructs redirect URL for authorization via M-Pin system
+// including the optional parameters from `p`.
+// Argument `state` is an opaque value set by the RP to maintain state between request and callback.
+// Argument `p` must be passed unchanged to `ValidateAuthWithParams` on callback.
+func (mc *client) GetAuthRequestURLWithParams(state string, p AuthParams) (string, error) {
+	return mc.GetAuthRequestURLWithParamsContext(context.Background(), state, p)
+}
+
+// GetAuthRequestURLWithParamsContext constructs redirect URL for authorization like `GetAuthRequestURLWithParams`.
+// Argument `ctx` is used for the discovery requests if the client is not initialized yet.
+func (mc *client) GetAuthRequestURLWithParamsContext(ctx context.Context, state string, p AuthParams) (string, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return "", err
+	}
+	return getAuthRequestURL(state, p, s.oauth)
+}
+
+func getAuthRequestURL(state string, p AuthParams, oac oauthClient) (u string, err error) {
 
 	uo, err := url.Parse(oac.AuthCodeURL(state, "", ""))
 	if err != nil {
 		return "", err
 	}
+	if p.CodeVerifier != "" || p.Nonce != "" {
+		q := uo.Query()
+		if p.CodeVerifier != "" {
+			q.Set("code_challenge", CodeChallenge(p.CodeVerifier))
+			q.Set("code_challenge_method", CodeChallengeMethodS256)
+		}
+		if p.Nonce != "" {
+			q.Set("nonce", p.Nonce)
+		}
+		uo.RawQuery = q.Encode()
+	}
 	u = uo.String()
 
 	return u, err
@@ -158,52 +561,188 @@ func getAuthRequestURL(state string, oac oauthClient) (u string, err error) {
 // ValidateAuth exchanges authorization code for access and id tokens if validation succeeds.
 // Argument `state` is an opaque value set by the RP to maintain state between request and callback.
 // Argument `code` is the authorization code sent back in the redirect from from authorization server.
+// Kept for compatibility, use `ValidateAuthToken` to get all the values of the token response.
 func (mc *client) ValidateAuth(code string) (string, jose.JWT, error) {
-	return validateAuth(code, mc.oidc, mc.oauth)
+	t, err := mc.ValidateAuthToken(code, AuthParams{})
+	if err != nil {
+		return "", jose.JWT{}, err
+	}
+	return t.AccessToken, t.IDToken, nil
 }
 
-func validateAuth(code string, oidc oidcClient, oac oauthClient) (string, jose.JWT, error) {
-
-	t, err := oac.RequestToken(oauth2.GrantTypeAuthCode, code)
+// ValidateAuthWithParams exchanges authorization code for access and id tokens if validation succeeds.
+// Argument `code` is the authorization code sent back in the redirect from from authorization server.
+// Argument `p` must hold the same values passed to `GetAuthRequestURLWithParams`.
+// Kept for compatibility, use `ValidateAuthToken` to get all the values of the token response.
+func (mc *client) ValidateAuthWithParams(code string, p AuthParams) (string, jose.JWT, error) {
+	t, err := mc.ValidateAuthToken(code, p)
 	if err != nil {
 		return "", jose.JWT{}, err
 	}
-	jwt, err := jose.ParseJWT(t.IDToken)
+	return t.AccessToken, t.IDToken, nil
+}
+
+// ValidateAuthToken exchanges authorization code for a `Token` if validation succeeds.
+// Argument `code` is the authorization code sent back in the redirect from from authorization server.
+// Argument `p` must hold the same values passed to `GetAuthRequestURLWithParams`.
+func (mc *client) ValidateAuthToken(code string, p AuthParams) (Token, error) {
+	return mc.ValidateAuthTokenContext(context.Background(), code, p)
+}
+
+// ValidateAuthTokenContext exchanges authorization code for a `Token` like `ValidateAuthToken`.
+// Argument `ctx` is used for the token request.
+func (mc *client) ValidateAuthTokenContext(ctx context.Context, code string, p AuthParams) (Token, error) {
+	s, err := mc.getState(ctx)
 	if err != nil {
-		return "", jose.JWT{}, err
+		return Token{}, err
 	}
-	if err = oidc.VerifyJWT(jwt); err != nil {
-		return "", jose.JWT{}, err
+	return validateAuth(ctx, code, p, s.oidc, s.oauth, mc.config.Clock)
+}
+
+func validateAuth(ctx context.Context, code string, p AuthParams, oidc oidcClient, oac oauthClient, clock clockwork.Clock) (Token, error) {
+
+	params := url.Values{}
+	if p.CodeVerifier != "" {
+		params.Set("code_verifier", p.CodeVerifier)
+	}
+
+	tr, err := oac.RequestToken(ctx, oauth2.GrantTypeAuthCode, code, params)
+	if err != nil {
+		return Token{}, err
+	}
+	t, err := newToken(ctx, tr, oidc, clock)
+	if err != nil {
+		return Token{}, err
+	}
+	if p.Nonce != "" {
+		if err = verifyNonce(t.IDToken, p.Nonce); err != nil {
+			return Token{}, err
+		}
 	}
 
-	return t.AccessToken, jwt, err
+	return t, err
 
 }
 
 // GetUserInfo retrieves `UserInfo` from authorization server.
 // Argument `accessToken` is the access token to be sent to authorization server.
+// Returns an error matching ErrUnsupported with errors.Is if the provider has no UserInfo endpoint.
 func (mc *client) GetUserInfo(accessToken string) (ui UserInfo, err error) {
-	return getUserInfo(mc.provider.UserInfoEndpoint.String(), accessToken, mc.config.HTTPClient)
+	return mc.GetUserInfoContext(context.Background(), accessToken)
+}
+
+// GetUserInfoContext retrieves `UserInfo` from authorization server like `GetUserInfo`.
+// Argument `ctx` is used for the UserInfo request.
+func (mc *client) GetUserInfoContext(ctx context.Context, accessToken string) (ui UserInfo, err error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return ui, err
+	}
+	endpoint, err := s.provider.userInfoEndpoint()
+	if err != nil {
+		return ui, err
+	}
+	return getUserInfo(ctx, endpoint, accessToken, mc.hc, s.userInfo)
 }
 
-func getUserInfo(userInfoEndoint, accessToken string, h httpDoer) (ui UserInfo, err error) {
+// GetUserInfoForToken retrieves `UserInfo` from authorization server using the access token of `t`
+// and verifies that it belongs to the subject of the ID token of `t`, as required by OIDC Core 5.3.2.
+// Returns `*SubjectMismatchError` if the subjects differ.
+func (mc *client) GetUserInfoForToken(t Token) (ui UserInfo, err error) {
+	return mc.GetUserInfoForTokenContext(context.Background(), t)
+}
+
+// GetUserInfoForTokenContext retrieves `UserInfo` for `t` like `GetUserInfoForToken`.
+// Argument `ctx` is used for the UserInfo request.
+func (mc *client) GetUserInfoForTokenContext(ctx context.Context, t Token) (ui UserInfo, err error) {
+	ui, _, err = mc.GetUserInfoClaimsContext(ctx, t)
+	return ui, err
+}
+
+// GetUserInfoClaims retrieves `UserInfo` for `t` like `GetUserInfoForToken`
+// along with all the claims of the response, including the non-standard ones.
+func (mc *client) GetUserInfoClaims(t Token) (ui UserInfo, claims UserInfoClaims, err error) {
+	return mc.GetUserInfoClaimsContext(context.Background(), t)
+}
+
+// GetUserInfoClaimsContext retrieves `UserInfo` and all the claims for `t` like `GetUserInfoClaims`.
+// Argument `ctx` is used for the UserInfo request.
+func (mc *client) GetUserInfoClaimsContext(ctx context.Context, t Token) (ui UserInfo, claims UserInfoClaims, err error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return ui, nil, err
+	}
+	endpoint, err := s.provider.userInfoEndpoint()
+	if err != nil {
+		return ui, nil, err
+	}
+	return getUserInfoForToken(ctx, endpoint, t, mc.hc, s.userInfo)
+}
+
+func getUserInfoForToken(ctx context.Context, userInfoEndoint string, t Token, h httpDoer, dec *userInfoDecoder) (ui UserInfo, claims UserInfoClaims, err error) {
+	sub := t.Subject()
+	if sub == "" {
+		return ui, nil, newError(ErrInvalidToken, errors.New("missing ID token claim: 'sub'"))
+	}
+
+	ui, claims, err = getUserInfoClaims(ctx, userInfoEndoint, t.AccessToken, h, dec)
+	if err != nil {
+		return ui, nil, err
+	}
+	if err = verifySubject(ui, sub); err != nil {
+		return UserInfo{}, nil, err
+	}
+
+	return ui, claims, nil
+}
+
+func getUserInfo(ctx context.Context, userInfoEndoint, accessToken string, h httpDoer, dec *userInfoDecoder) (ui UserInfo, err error) {
+	ui, _, err = getUserInfoClaims(ctx, userInfoEndoint, accessToken, h, dec)
+	return ui, err
+}
+
+// getUserInfoClaims retrieves the UserInfo and all its claims with `accessToken`.
+func getUserInfoClaims(ctx context.Context, userInfoEndoint, accessToken string, h httpDoer, dec *userInfoDecoder) (ui UserInfo, claims UserInfoClaims, err error) {
 
 	req, err := http.NewRequest("GET", userInfoEndoint, new(bytes.Buffer))
 	if err != nil {
-		return ui, err
+		return ui, nil, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	resp, err := h.Do(req)
 	if err != nil {
-		return ui, err
+		return ui, nil, newError(ErrProviderUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
+	contentType, body, err := readUserInfoResponse(resp)
+	if err != nil {
+		return ui, nil, err
+	}
+	switch contentType {
+	case "application/json":
+	case "application/jwt":
+		if dec == nil {
+			return ui, nil, newError(ErrUserInfo, errors.New("signed response not supported"))
+		}
+		if body, err = dec.decode(ctx, body); err != nil {
+			return ui, nil, err
+		}
+	default:
+		return ui, nil, newError(ErrUserInfo, fmt.Errorf("unsupported content type %q", contentType))
+	}
+
 	if err = json.Unmarshal(body, &ui); err != nil {
-		return UserInfo{}, err
+		return UserInfo{}, nil, newError(ErrUserInfo, err)
+	}
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return UserInfo{}, nil, newError(ErrUserInfo, err)
+	}
+	if ui.UserID == "" {
+		return UserInfo{}, nil, newError(ErrUserInfo, errors.New("missing claim: 'sub'"))
 	}
 
-	return ui, err
+	return ui, claims, nil
 }
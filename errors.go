@@ -0,0 +1,92 @@
+package maas
+
+import (
+	"errors"
+
+	"github.com/coreos/go-oidc/oauth2"
+)
+
+// Kinds of the errors returned by the SDK. They can be matched with errors.Is.
+var (
+	// ErrProviderUnavailable is returned when the authorization server cannot be reached
+	// or responds with a server error. The operation can be retried later.
+	ErrProviderUnavailable = errors.New("provider unavailable")
+	// ErrInvalidGrant is returned when the authorization code or the refresh token
+	// is invalid, expired, revoked or was issued to another client.
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrAccessDenied is returned when the user or the authorization server denied the authorization.
+	ErrAccessDenied = errors.New("access denied")
+	// ErrAuthorization is returned when the authorization server responds with any other OAuth 2.0 error.
+	ErrAuthorization = errors.New("authorization error")
+	// ErrMalformedToken is returned when a token cannot be parsed.
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrInvalidSignature is returned when the signature of a token cannot be verified with the provider keys.
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned when a token has expired.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrInvalidIssuer is returned when the issuer of a token is not the provider.
+	ErrInvalidIssuer = errors.New("invalid token issuer")
+	// ErrInvalidAudience is returned when a token was not issued for the client.
+	ErrInvalidAudience = errors.New("invalid token audience")
+	// ErrInvalidToken is returned when a token has any other invalid or missing claim.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrNonceMismatch is returned when the nonce of the ID token doesn't match the one sent.
+	ErrNonceMismatch = errors.New("nonce mismatch")
+	// ErrUserInfo is returned when the UserInfo response cannot be processed.
+	ErrUserInfo = errors.New("user info error")
+	// ErrSubjectMismatch is returned when the subject of the UserInfo doesn't match the subject of the ID token.
+	ErrSubjectMismatch = errors.New("subject mismatch")
+	// ErrInsufficientScope is returned when an access token doesn't grant the required scopes.
+	ErrInsufficientScope = errors.New("insufficient scope")
+	// ErrUnsupported is returned when the provider doesn't support the operation, e.g. doesn't advertise its endpoint.
+	ErrUnsupported = errors.New("unsupported by provider")
+)
+
+// ErrClientClosed is returned when a closed client is used.
+var ErrClientClosed = errors.New("client closed")
+
+// ErrAudienceRequired is returned when an access token is validated without `Config.Audience` set.
+var ErrAudienceRequired = errors.New("audience required for access token validation")
+
+// Error is the error returned by the SDK for failures of the OIDC and OAuth 2.0 operations.
+// Its `Kind` is one of the Err* values above and the underlying cause (e.g. *oauth2.Error)
+// can be retrieved with errors.As.
+type Error struct {
+	Kind error // One of the Err* values.
+	Err  error // Underlying cause. Can be nil.
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of kind `target`.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func newError(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// newOAuthError wraps an error response of the authorization server.
+func newOAuthError(err *oauth2.Error) error {
+	switch err.Type {
+	case oauth2.ErrorInvalidGrant:
+		return newError(ErrInvalidGrant, err)
+	case oauth2.ErrorAccessDenied:
+		return newError(ErrAccessDenied, err)
+	case oauth2.ErrorServerError, "temporarily_unavailable":
+		return newError(ErrProviderUnavailable, err)
+	default:
+		return newError(ErrAuthorization, err)
+	}
+}
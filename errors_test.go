@@ -0,0 +1,58 @@
+package maas
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oauth2"
+)
+
+// newTestSignedJWT signs `claims` with `k`.
+func newTestSignedJWT(t *testing.T, k *key.PrivateKey, claims jose.Claims) jose.JWT {
+	jwt, err := jose.NewSignedJWT(claims, k.Signer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *jwt
+}
+
+func TestErrorIs(t *testing.T) {
+	cause := &oauth2.Error{Type: oauth2.ErrorInvalidGrant}
+	err := newError(ErrInvalidGrant, cause)
+
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Error("Error is not of its kind")
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		t.Error("Error is of other kind")
+	}
+	var oerr *oauth2.Error
+	if !errors.As(err, &oerr) || oerr != cause {
+		t.Error("Cause not unwrapped")
+	}
+	if err.Error() != "invalid grant: invalid_grant" {
+		t.Errorf("Wrong error message %q", err.Error())
+	}
+	if newError(ErrUserInfo, nil).Error() != "user info error" {
+		t.Error("Wrong error message without cause")
+	}
+}
+
+func TestNewOAuthError(t *testing.T) {
+	cases := map[string]error{
+		oauth2.ErrorInvalidGrant:   ErrInvalidGrant,
+		oauth2.ErrorAccessDenied:   ErrAccessDenied,
+		oauth2.ErrorServerError:    ErrProviderUnavailable,
+		"temporarily_unavailable":  ErrProviderUnavailable,
+		oauth2.ErrorInvalidClient:  ErrAuthorization,
+		oauth2.ErrorInvalidRequest: ErrAuthorization,
+	}
+
+	for typ, kind := range cases {
+		if err := newOAuthError(&oauth2.Error{Type: typ}); !errors.Is(err, kind) {
+			t.Errorf("Expected %v for %v, got %v", kind, typ, err)
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
-	"time"
 
 	"github.com/miracl/maas-sdk-go"
 )
@@ -15,7 +14,6 @@ import (
 const (
 	serviceName = "rpa-example"
 	serviceID   = "rpa-example"
-	state       = "test-state"
 	seesionKey  = "session-key"
 )
 
@@ -23,52 +21,15 @@ var (
 	clientID     = flag.String("client-id", "", "OIDC Client Id")
 	clientSecret = flag.String("client-secret", "", "OIDC Client Secret")
 	redirectURL  = flag.String("redirect", "", "Redirect URL")
+	logoutURL    = flag.String("post-logout-redirect", "", "Post logout redirect URL")
 	addr         = flag.String("addr", ":8002", "Listen address")
 	templatesDir = flag.String("templates-dir", "templates", "Template files location")
-	debug        = flag.Bool("debug", false, "Debug mode")
 
 	backend = flag.String("backend", maas.DiscoveryURI, "Backend url")
 
 	mc maas.Client
 )
 
-// Below there is an exemplary implementation of server side session.
-// It is overly simplistic for the purposes of the example, as the main point
-// is the usage of the SDK.
-// Real applications could / should implement session in more advanced manner
-// or use whatever is provided from the framework they use.
-
-// CheckSession verifies that the request provides a valid session.
-func checkSession(r *http.Request, sessions map[string]maas.UserInfo) (user maas.UserInfo, err error) {
-	c, err := r.Cookie("session")
-	if err != nil {
-		return user, err
-	}
-	user, ok := sessions[c.Value]
-	if !ok {
-		return maas.UserInfo{}, fmt.Errorf("Session %v does not exist", c.Value)
-	}
-	return user, err
-}
-
-// CreateSession creates a new valid session
-func createSession(w http.ResponseWriter, user maas.UserInfo, sessions map[string]maas.UserInfo) {
-	sessionID := time.Now().Format(time.RFC850)
-	sessions[sessionID] = user
-	expiration := time.Now().Add(24 * time.Hour)
-	cookie := http.Cookie{Name: "session", Value: sessionID, Expires: expiration}
-	http.SetCookie(w, &cookie)
-}
-
-// DeleteSession removes (invalidates) session
-func deleteSession(r *http.Request, w http.ResponseWriter, sessions map[string]maas.UserInfo) {
-	c, _ := r.Cookie("session")
-	delete(sessions, c.Value)
-	c.Value = ""
-	c.Expires = time.Time{}
-	http.SetCookie(w, c)
-}
-
 // Flash is a one time message to be displayed
 type flash struct {
 	Category string
@@ -109,63 +70,39 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	sessions := map[string]maas.UserInfo{}
-
-	http.HandleFunc("/oidc", func(w http.ResponseWriter, r *http.Request) {
-		ctx := context{}
-		ctx.Messages = make([]flash, 10)
-
-		code := r.URL.Query().Get("code")
-		// CExchange authorization code for access token
-		accessToken, jwt, err := mc.ValidateAuth(code)
-		if err != nil {
-			// if authorization code is invalid, redirect to index
-			log.Printf("Invalid authentication code: %v\n", code)
-			log.Println(err)
-			http.Redirect(w, r, "/", 302)
-			return
-		}
-		if *debug {
-			claims, _ := jwt.Claims()
-			log.Printf("Access token: %v", accessToken)
-			log.Printf("JTW payload: %+v", claims)
-		}
-
-		// Retrieve use info from oidc server
-		user, err := mc.GetUserInfo(accessToken)
-		if err != nil {
-			ctx.Messages = append(ctx.Messages, flash{Category: "error", Message: err.Error()})
+	defer mc.Close()
+
+	// The SDK handler takes care for the login (`/login`), callback (`/oidc`)
+	// and logout (`/logout`) routes, as well as for the state and the sessions.
+	// The logout route also revokes the tokens of the user at the authorization server
+	// and, if the post logout redirect URL is set, logs the user out there as well,
+	// handling the redirect back on `/logout/callback`.
+	// Real applications could / should use a persistent session store.
+	h := maas.NewHandler(mc, maas.HandlerConfig{
+		PostLogoutRedirectURI: *logoutURL,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// Show the login page, along with the error message
 			log.Println(err)
-		} else {
-			// If user info is successfully retrieved, create session and
-			// redirect to `protected` page
-			createSession(w, user, sessions)
-			http.Redirect(w, r, "/", 302)
-			return
-		}
-
-		// Else show the login page, along with any error messages
-		if t, err := template.New("index.tmpl").ParseFiles(filepath.Join(*templatesDir, "index.tmpl")); err != nil {
-			log.Fatalf("Failed to parse template: %+v", err)
-		} else {
-			t.Execute(w, ctx)
-		}
-	})
-	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		// On logout delete session and redirect to index
-		deleteSession(r, w, sessions)
-		http.Redirect(w, r, "/", 302)
+			ctx := context{}
+			ctx.Messages = []flash{{Category: "error", Message: errorMessage(err)}}
+			if t, err := template.New("index.tmpl").ParseFiles(filepath.Join(*templatesDir, "index.tmpl")); err != nil {
+				log.Fatalf("Failed to parse template: %+v", err)
+			} else {
+				t.Execute(w, ctx)
+			}
+		},
 	})
+	h.Register(http.DefaultServeMux)
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 
 		ctx := context{}
 		ctx.Messages = make([]flash, 0)
 
-		if user, err := checkSession(r, sessions); err != nil {
+		if session, err := h.Session(r); err != nil {
 			// If user is not logged, populate authURL for mpad
 			// so the user can authenticate
-			authURL, e := mc.GetAuthRequestURL("test-state")
+			authURL, e := h.AuthRequestURL(w, r)
 			if e != nil {
 				ctx.Messages = append(ctx.Messages, flash{Category: "error", Message: e.Error()})
 			}
@@ -173,8 +110,8 @@ func main() {
 		} else {
 			// Else display info for logged user (this is `protected` page)
 			ctx.Authorized = true
-			ctx.UserID = user.UserID
-			ctx.Email = user.Email
+			ctx.UserID = session.UserInfo.UserID
+			ctx.Email = session.UserInfo.Email
 		}
 
 		if t, err := template.New("index.tmpl").ParseFiles(filepath.Join(*templatesDir, "index.tmpl")); err != nil {
@@ -191,3 +128,17 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// errorMessage returns a message describing `err` to the user.
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, maas.ErrAccessDenied):
+		return "Login was canceled."
+	case errors.Is(err, maas.ErrInvalidState), errors.Is(err, maas.ErrInvalidGrant):
+		return "Login has expired, please try again."
+	case errors.Is(err, maas.ErrProviderUnavailable):
+		return "The authorization server is not available, please try again later."
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,272 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const returnToCookieName = "maas_return_to"
+
+// HandlerConfig is configuration struct for initializing a Handler object with NewHandler.
+type HandlerConfig struct {
+	States                 StateStore                                              // Store for the authorization request state. If left out, `MemoryStateStore` will be used.
+	Sessions               SessionStore                                            // Store for the sessions of logged in users. If left out, `MemorySessionStore` will be used.
+	LoginPath              string                                                  // Path of the login route. If left out, "/login" will be used.
+	CallbackPath           string                                                  // Path of the callback route. Must match the path of `Config.RedirectURI`. If left out, "/oidc" will be used.
+	LogoutPath             string                                                  // Path of the logout route. If left out, "/logout" will be used.
+	PostLogoutRedirectURI  string                                                  // URI the authorization server redirects back to after logout (`post_logout_redirect_uri`). Must be registered for the client. If set, the logout route ends the session at the authorization server too.
+	LogoutCallbackPath     string                                                  // Path of the logout callback route. Must match the path of `PostLogoutRedirectURI`. If left out, "/logout/callback" will be used.
+	RedirectPath           string                                                  // Path the user is redirected to after login or logout. If left out, "/" will be used.
+	ErrorHandler           func(w http.ResponseWriter, r *http.Request, err error) // Called when the authorization fails. If left out, 401 Unauthorized is returned.
+	RevocationErrorHandler func(r *http.Request, err error)                        // Called when the revocation of the tokens fails on logout. The logout proceeds regardless. If left out, the error is ignored.
+}
+
+// Handler provides ready-made net/http handlers for the authorization flow
+// and a middleware protecting handlers that require an authorized user.
+type Handler struct {
+	client Client
+	config HandlerConfig
+}
+
+type contextKey int
+
+const (
+	userInfoContextKey contextKey = iota
+	accessTokenContextKey
+)
+
+func populateDefaultHandlerConfig(cfg HandlerConfig) HandlerConfig {
+	if cfg.States == nil {
+		cfg.States = NewMemoryStateStore()
+	}
+	if cfg.Sessions == nil {
+		cfg.Sessions = NewMemorySessionStore()
+	}
+	if cfg.LoginPath == "" {
+		cfg.LoginPath = "/login"
+	}
+	if cfg.CallbackPath == "" {
+		cfg.CallbackPath = "/oidc"
+	}
+	if cfg.LogoutPath == "" {
+		cfg.LogoutPath = "/logout"
+	}
+	if cfg.LogoutCallbackPath == "" {
+		cfg.LogoutCallbackPath = "/logout/callback"
+	}
+	if cfg.RedirectPath == "" {
+		cfg.RedirectPath = "/"
+	}
+	if cfg.ErrorHandler == nil {
+		cfg.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+	}
+	if cfg.RevocationErrorHandler == nil {
+		cfg.RevocationErrorHandler = func(r *http.Request, err error) {
+			// The revocation failure is ignored, the session is removed anyway.
+		}
+	}
+	return cfg
+}
+
+// NewHandler instantiates a new `Handler` object using `mc` for communicating with the authorization server.
+func NewHandler(mc Client, cfg HandlerConfig) *Handler {
+	return &Handler{
+		client: mc,
+		config: populateDefaultHandlerConfig(cfg),
+	}
+}
+
+// Register mounts the login, callback and logout routes on `mux`.
+// The logout callback route is mounted only if `PostLogoutRedirectURI` is set.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(h.config.LoginPath, h.Login)
+	mux.HandleFunc(h.config.CallbackPath, h.Callback)
+	mux.HandleFunc(h.config.LogoutPath, h.Logout)
+	if h.config.PostLogoutRedirectURI != "" {
+		mux.HandleFunc(h.config.LogoutCallbackPath, h.LogoutCallback)
+	}
+}
+
+// AuthRequestURL returns authorization request URL for the browser making request `r`.
+// It can be used with `mpad.js` instead of redirecting to the login route.
+func (h *Handler) AuthRequestURL(w http.ResponseWriter, r *http.Request) (string, error) {
+	return NewAuthRequestURL(h.client, h.config.States, w, r)
+}
+
+// Session returns the session of the browser making request `r` or ErrNoSession if the user is not logged in.
+func (h *Handler) Session(r *http.Request) (Session, error) {
+	return h.config.Sessions.Get(r)
+}
+
+// Login redirects the browser to the authorization server.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	authURL, err := h.AuthRequestURL(w, r)
+	if err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback handles the redirect from the authorization server.
+// It validates the authorization, retrieves the user info and creates a session for the user.
+func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
+	t, err := ValidateCallback(h.client, h.config.States, w, r)
+	if err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+
+	ui, err := h.client.GetUserInfoForTokenContext(r.Context(), t)
+	if err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+
+	err = h.config.Sessions.Save(w, r, Session{
+		UserInfo: ui,
+		Token:    t,
+	})
+	if err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+
+	redirect := h.config.RedirectPath
+	if c, err := r.Cookie(returnToCookieName); err == nil {
+		if isLocalPath(c.Value) {
+			redirect = c.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: returnToCookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// Logout removes the session of the user, revokes its tokens at the authorization server
+// and redirects the browser to `RedirectPath`.
+// The session is removed even if the revocation fails, but the error is passed to `RevocationErrorHandler`.
+// Providers without a revocation endpoint are not an error.
+// If `PostLogoutRedirectURI` is set, the browser is redirected to the authorization server
+// to end the session there as well, unless the provider doesn't support it.
+// Only POST requests from pages of the same origin are accepted, so other sites can't log the user out.
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	s, err := h.config.Sessions.Get(r)
+	if err != nil && err != ErrNoSession {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+	if err = h.config.Sessions.Delete(w, r); err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+	// A failed revocation must not keep the user logged in at the authorization server.
+	if err = revokeTokens(r.Context(), h.client, s.Token); err != nil {
+		h.config.RevocationErrorHandler(r, err)
+	}
+
+	redirect := h.config.RedirectPath
+	if h.config.PostLogoutRedirectURI != "" {
+		logoutURL, err := NewLogoutURL(h.client, h.config.States, w, r, s.Token, h.config.PostLogoutRedirectURI)
+		switch {
+		case err == nil:
+			redirect = logoutURL
+		case !errors.Is(err, ErrUnsupported):
+			h.config.ErrorHandler(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// LogoutCallback handles the redirect from the authorization server after logout.
+// It validates the state and redirects the browser to `RedirectPath`.
+func (h *Handler) LogoutCallback(w http.ResponseWriter, r *http.Request) {
+	if err := ValidateLogoutCallback(h.config.States, w, r); err != nil {
+		h.config.ErrorHandler(w, r, err)
+		return
+	}
+	http.Redirect(w, r, h.config.RedirectPath, http.StatusFound)
+}
+
+// revokeTokens revokes the refresh and the access token of `t`.
+// Both are attempted and the first error is returned.
+func revokeTokens(ctx context.Context, mc Client, t Token) (err error) {
+	for _, tt := range []struct{ token, hint string }{
+		{t.RefreshToken, TokenTypeHintRefreshToken},
+		{t.AccessToken, TokenTypeHintAccessToken},
+	} {
+		if tt.token == "" {
+			continue
+		}
+		if e := mc.RevokeTokenContext(ctx, tt.token, tt.hint); e != nil && !errors.Is(e, ErrUnsupported) && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RequireAuth is a middleware which allows only requests of logged in users to reach `next`.
+// Other users are redirected to the authorization server and back to the requested page after login.
+// The `UserInfo` of the user can be retrieved from the request context with `UserInfoFromContext`.
+func (h *Handler) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := h.config.Sessions.Get(r)
+		if err != nil {
+			if r.Method == "GET" {
+				http.SetCookie(w, &http.Cookie{
+					Name:     returnToCookieName,
+					Value:    r.URL.RequestURI(),
+					Path:     "/",
+					MaxAge:   int(StateTTL.Seconds()),
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+			h.Login(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userInfoContextKey, s.UserInfo)))
+	})
+}
+
+// UserInfoFromContext returns the `UserInfo` placed in the context by `RequireAuth`.
+func UserInfoFromContext(ctx context.Context) (UserInfo, bool) {
+	ui, ok := ctx.Value(userInfoContextKey).(UserInfo)
+	return ui, ok
+}
+
+// isLocalPath reports whether `p` is a path on the same host, so it is safe to redirect to it.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// isSameOrigin reports whether request `r` was made by a page of the same origin, according to its `Origin` header
+// or, if the browser didn't send it, its `Referer` header. Requests without both are not made by browsers on behalf of other sites.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
@@ -0,0 +1,301 @@
+package maas
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+func newTestHandler(mc Client) (*Handler, *http.ServeMux) {
+	h := NewHandler(mc, HandlerConfig{})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	mux.Handle("/protected", h.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ui, ok := UserInfoFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(ui.UserID))
+	})))
+	return h, mux
+}
+
+// login performs the login flow and returns the recorder holding the session cookie.
+func login(t *testing.T, mux *http.ServeMux, mc *testClient) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != mc.URL {
+		t.Fatalf("Login not redirected to authorization URL: %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+
+	cb := httptest.NewRecorder()
+	mux.ServeHTTP(cb, withCookies(rec, "GET", "/oidc?code=test-code&state="+mc.State))
+	if cb.Code != http.StatusFound || cb.Header().Get("Location") != "/" {
+		t.Fatalf("Callback not redirected to index: %v %v", cb.Code, cb.Header().Get("Location"))
+	}
+	return cb
+}
+
+func TestHandlerLogin(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize", Token: Token{AccessToken: "test-ac"}, UserInfo: UserInfo{UserID: "test"}}
+	h, mux := newTestHandler(mc)
+
+	rec := login(t, mux, mc)
+
+	if mc.Code != "test-code" {
+		t.Error("Wrong code exchanged")
+	}
+	s, err := h.Session(withCookies(rec, "GET", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UserInfo != mc.UserInfo || s.Token.AccessToken != "test-ac" {
+		t.Errorf("Wrong session created %+v", s)
+	}
+}
+
+func TestHandlerCallbackError(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize"}
+	var handled error
+	h := NewHandler(mc, HandlerConfig{
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			handled = err
+			w.WriteHeader(http.StatusBadRequest)
+		},
+	})
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/oidc?code=test-code&state=test-state", nil))
+
+	if handled != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState, got %v", handled)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Error handler not used")
+	}
+}
+
+func TestHandlerCallbackUserInfoError(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize"}
+	_, mux := newTestHandler(mc)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	mc.Err = errors.New("test error")
+
+	cb := httptest.NewRecorder()
+	mux.ServeHTTP(cb, withCookies(rec, "GET", "/oidc?code=test-code&state="+mc.State))
+	if cb.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %v", cb.Code)
+	}
+	if len(cb.Result().Cookies()) != 1 || cb.Result().Cookies()[0].Name != StateCookieName {
+		t.Error("Unexpected cookies set on failed login")
+	}
+}
+
+func TestHandlerLogout(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize", Token: Token{AccessToken: "test-ac", RefreshToken: "test-rt"}, UserInfo: UserInfo{UserID: "test"}}
+	h, mux := newTestHandler(mc)
+	sessionRec := login(t, mux, mc)
+
+	r := withCookies(sessionRec, "POST", "/logout")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Errorf("Logout not redirected to index: %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+	if _, err := h.Session(r); err != ErrNoSession {
+		t.Error("Session not deleted")
+	}
+	if !reflect.DeepEqual(mc.Revoked, []string{"test-rt", TokenTypeHintRefreshToken, "test-ac", TokenTypeHintAccessToken}) {
+		t.Errorf("Wrong tokens revoked %v", mc.Revoked)
+	}
+}
+
+func TestHandlerLogoutForbidden(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize", Token: Token{AccessToken: "test-ac"}, UserInfo: UserInfo{UserID: "test"}}
+	h, mux := newTestHandler(mc)
+	sessionRec := login(t, mux, mc)
+
+	cases := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		status int
+	}{
+		{"GET", "GET", "", "", http.StatusMethodNotAllowed},
+		{"other origin", "POST", "Origin", "https://attacker.example.net", http.StatusForbidden},
+		{"null origin", "POST", "Origin", "null", http.StatusForbidden},
+		{"other referer", "POST", "Referer", "https://attacker.example.net/page", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := withCookies(sessionRec, c.method, "/logout")
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+
+		if rec.Code != c.status {
+			t.Errorf("%v: wrong status %v", c.name, rec.Code)
+		}
+		if _, err := h.Session(r); err != nil {
+			t.Errorf("%v: session deleted", c.name)
+		}
+	}
+	if len(mc.Revoked) != 0 {
+		t.Errorf("Tokens revoked %v", mc.Revoked)
+	}
+
+	// Same origin
+	r := withCookies(sessionRec, "POST", "/logout")
+	r.Header.Set("Origin", "http://"+r.Host)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("Logout from the same origin failed: %v", rec.Code)
+	}
+}
+
+func TestHandlerLogoutRevocationError(t *testing.T) {
+	for _, c := range []struct {
+		err     error
+		handled bool
+	}{
+		{newError(ErrProviderUnavailable, errors.New("test")), true},
+		{newError(ErrUnsupported, errors.New("test")), false},
+	} {
+		mc := &testClient{URL: "https://example.com/authorize", Token: Token{AccessToken: "test-ac"}, UserInfo: UserInfo{UserID: "test"}}
+		var handled error
+		h := NewHandler(mc, HandlerConfig{
+			PostLogoutRedirectURI: "http://example.com/logout/callback",
+			RevocationErrorHandler: func(r *http.Request, err error) {
+				handled = err
+			},
+		})
+		mux := http.NewServeMux()
+		h.Register(mux)
+		sessionRec := login(t, mux, mc)
+
+		mc.RevokeErr = c.err
+		mc.LogoutURL = "https://example.com/logout"
+		r := withCookies(sessionRec, "POST", "/logout")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+
+		if (handled != nil) != c.handled {
+			t.Errorf("%v: handled error %v", c.err, handled)
+		}
+		if _, err := h.Session(r); err != ErrNoSession {
+			t.Errorf("%v: session not deleted", c.err)
+		}
+		if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != mc.LogoutURL {
+			t.Errorf("%v: not redirected to the end session endpoint: %v %v", c.err, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize", UserInfo: UserInfo{UserID: "test"}}
+	_, mux := newTestHandler(mc)
+
+	// Not logged in
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/protected?x=1", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != mc.URL {
+		t.Fatalf("Not redirected to authorization URL: %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Callback redirects back to the protected page
+	cb := httptest.NewRecorder()
+	mux.ServeHTTP(cb, withCookies(rec, "GET", "/oidc?code=test-code&state="+mc.State))
+	if cb.Header().Get("Location") != "/protected?x=1" {
+		t.Errorf("Not redirected back to requested page: %v", cb.Header().Get("Location"))
+	}
+
+	// Logged in
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withCookies(cb, "GET", "/protected"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v", rec.Code)
+	}
+	if rec.Body.String() != "test" {
+		t.Error("Wrong user info in context")
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	cases := map[string]bool{
+		"/":                    true,
+		"/protected?x=1":       true,
+		"//evil.example.com":   false,
+		"/\\evil.example.com":  false,
+		"https://evil.example": false,
+		"":                     false,
+	}
+	for p, expected := range cases {
+		if isLocalPath(p) != expected {
+			t.Errorf("isLocalPath(%q) != %v", p, expected)
+		}
+	}
+}
+
+func TestHandlerLogoutEndSession(t *testing.T) {
+	idToken := newTestSignedJWT(t, newTestPrivateKey(t), jose.Claims{"sub": "test"})
+	mc := &testClient{
+		URL:       "https://example.com/authorize",
+		LogoutURL: "https://example.com/logout?state=test",
+		Token:     Token{AccessToken: "test-ac", IDToken: idToken},
+		UserInfo:  UserInfo{UserID: "test"},
+	}
+	h := NewHandler(mc, HandlerConfig{PostLogoutRedirectURI: "http://example.com/logout/callback"})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	sessionRec := login(t, mux, mc)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, withCookies(sessionRec, "POST", "/logout"))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != mc.LogoutURL {
+		t.Fatalf("Logout not redirected to authorization server: %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+	if mc.IDTokenHint != idToken.Encode() || mc.PostLogoutRedirectURI != "http://example.com/logout/callback" || mc.LogoutState == "" {
+		t.Errorf("Wrong logout URL parameters %q %q %q", mc.IDTokenHint, mc.PostLogoutRedirectURI, mc.LogoutState)
+	}
+
+	// Wrong state
+	cb := httptest.NewRecorder()
+	mux.ServeHTTP(cb, withCookies(rec, "GET", "/logout/callback?state=other"))
+	if cb.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong state, got %v", cb.Code)
+	}
+
+	cb = httptest.NewRecorder()
+	mux.ServeHTTP(cb, withCookies(rec, "GET", "/logout/callback?state="+mc.LogoutState))
+	if cb.Code != http.StatusFound || cb.Header().Get("Location") != "/" {
+		t.Errorf("Logout callback not redirected to index: %v %v", cb.Code, cb.Header().Get("Location"))
+	}
+}
+
+func TestHandlerLogoutEndSessionUnsupported(t *testing.T) {
+	mc := &testClient{URL: "https://example.com/authorize", UserInfo: UserInfo{UserID: "test"}}
+	h := NewHandler(mc, HandlerConfig{PostLogoutRedirectURI: "http://example.com/logout/callback"})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	sessionRec := login(t, mux, mc)
+
+	mc.Err = newError(ErrUnsupported, errors.New("test"))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, withCookies(sessionRec, "POST", "/logout"))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Errorf("Logout not redirected to index: %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+}
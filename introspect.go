@@ -0,0 +1,235 @@
+package maas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/jonboulle/clockwork"
+)
+
+// Introspection is the state of a token returned by the introspection endpoint (RFC 7662 2.2).
+// All the fields except `Active` are empty if the token is not active.
+type Introspection struct {
+	Active    bool        // Whether the token is active, i.e. issued by the provider, not expired and not revoked (`active`).
+	Scope     []string    // Scopes granted by the token (`scope`).
+	ClientID  string      // Client the token was issued to (`client_id`).
+	Username  string      // Human-readable identifier of the user who authorized the token (`username`).
+	TokenType string      // Type of the token (`token_type`).
+	Expiry    time.Time   // Expiry of the token (`exp`). Zero if not present.
+	IssuedAt  time.Time   // Time the token was issued (`iat`). Zero if not present.
+	NotBefore time.Time   // Time before which the token is not valid (`nbf`). Zero if not present.
+	Subject   string      // Subject of the token (`sub`), the user or the client it was issued for.
+	Audience  []string    // Audience of the token (`aud`).
+	Issuer    string      // Issuer of the token (`iss`).
+	JWTID     string      // Identifier of the token (`jti`).
+	Claims    jose.Claims // All the members of the introspection response.
+}
+
+// HasScope reports whether the token grants `scope`.
+func (i Introspection) HasScope(scope string) bool {
+	for _, s := range i.Scope {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Introspect asks the authorization server for the state of `token` (RFC 7662).
+// The request is authenticated with the client credentials of `Config`.
+// An inactive token is not an error, check `Active` of the result.
+// Returns an error matching ErrUnsupported with errors.Is if the provider has no introspection endpoint.
+func (mc *client) Introspect(token string) (Introspection, error) {
+	return mc.IntrospectContext(context.Background(), token)
+}
+
+// IntrospectContext asks the authorization server for the state of `token` like `Introspect`.
+// Argument `ctx` is used for the introspection request.
+func (mc *client) IntrospectContext(ctx context.Context, token string) (Introspection, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return Introspection{}, err
+	}
+	return introspect(ctx, token, s.oauth, mc.introspections)
+}
+
+func introspect(ctx context.Context, token string, oac oauthClient, cache *introspectionCache) (Introspection, error) {
+	if i, ok := cache.get(token); ok {
+		return i, nil
+	}
+
+	i, err := oac.Introspect(ctx, token)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if i.Active {
+		cache.put(token, i)
+	}
+	return i, nil
+}
+
+// Introspect sends `token` to the introspection endpoint.
+func (c *oauth2Client) Introspect(ctx context.Context, token string) (Introspection, error) {
+	if c.introspectionURL == "" {
+		return Introspection{}, newError(ErrUnsupported, errors.New("no introspection endpoint"))
+	}
+
+	req, err := c.newAuthenticatedRequest(c.introspectionURL, url.Values{"token": {token}})
+	if err != nil {
+		return Introspection{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return Introspection{}, newError(ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	return parseIntrospectionResponse(resp)
+}
+
+// parseIntrospectionResponse parses the response of the introspection endpoint (RFC 7662 2.2).
+func parseIntrospectionResponse(resp *http.Response) (Introspection, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Introspection{}, newError(ErrProviderUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Introspection{}, parseErrorResponse(resp, body)
+	}
+
+	var claims jose.Claims
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return Introspection{}, newError(ErrAuthorization, fmt.Errorf("invalid introspection response: %v", err))
+	}
+	active, ok := claims["active"].(bool)
+	if !ok {
+		return Introspection{}, newError(ErrAuthorization, errors.New("invalid introspection response: missing 'active'"))
+	}
+	if !active {
+		return Introspection{}, nil
+	}
+
+	i := Introspection{
+		Active:   true,
+		Scope:    scopeClaim(claims),
+		Audience: audienceClaim(claims),
+		Claims:   claims,
+	}
+	i.ClientID, _, _ = claims.StringClaim("client_id")
+	i.Username, _, _ = claims.StringClaim("username")
+	i.TokenType, _, _ = claims.StringClaim("token_type")
+	i.Subject, _, _ = claims.StringClaim("sub")
+	i.Issuer, _, _ = claims.StringClaim("iss")
+	i.JWTID, _, _ = claims.StringClaim("jti")
+	i.Expiry, _, _ = claims.TimeClaim("exp")
+	i.IssuedAt, _, _ = claims.TimeClaim("iat")
+	i.NotBefore, _, _ = claims.TimeClaim("nbf")
+
+	return i, nil
+}
+
+// audienceClaim returns the audience of the `aud` claim, which is either a string or an array.
+func audienceClaim(claims jose.Claims) []string {
+	if aud, ok, err := claims.StringClaim("aud"); err == nil && ok {
+		return []string{aud}
+	}
+	auds, _, _ := claims.StringsClaim("aud")
+	return auds
+}
+
+// introspectionCache keeps the active introspection results in memory for at most `ttl`
+// and never past the expiry of the token. The tokens are stored hashed.
+// A nil cache caches nothing.
+type introspectionCache struct {
+	ttl   time.Duration
+	clock clockwork.Clock
+
+	mu      sync.Mutex
+	entries map[string]introspectionEntry
+	swept   time.Time // Time of the last removal of the expired entries.
+}
+
+type introspectionEntry struct {
+	result    Introspection
+	expiresAt time.Time
+}
+
+func newIntrospectionCache(ttl time.Duration, clock clockwork.Clock) *introspectionCache {
+	return &introspectionCache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: map[string]introspectionEntry{},
+		swept:   clock.Now(),
+	}
+}
+
+func introspectionCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached result for `token` if it is there and not expired.
+func (c *introspectionCache) get(token string) (Introspection, bool) {
+	if c == nil {
+		return Introspection{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[introspectionCacheKey(token)]
+	if !ok || !c.clock.Now().Before(e.expiresAt) {
+		return Introspection{}, false
+	}
+	return e.result, true
+}
+
+// delete removes the cached result for `token`.
+func (c *introspectionCache) delete(token string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, introspectionCacheKey(token))
+}
+
+// put caches the result for `token`. The expired entries are removed at most once per `ttl`.
+func (c *introspectionCache) put(token string, i Introspection) {
+	if c == nil {
+		return
+	}
+	now := c.clock.Now()
+	expiresAt := now.Add(c.ttl)
+	if !i.Expiry.IsZero() && i.Expiry.Before(expiresAt) {
+		expiresAt = i.Expiry
+	}
+	if !now.Before(expiresAt) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.swept) >= c.ttl {
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[introspectionCacheKey(token)] = introspectionEntry{result: i, expiresAt: expiresAt}
+}
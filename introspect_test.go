@@ -0,0 +1,201 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestOAuth2ClientIntrospect(t *testing.T) {
+	d := &testDoer{
+		Response: newTestResponse(200, "application/json", `{"active":true,"scope":"openid read","client_id":"test-client","username":"test-user","token_type":"Bearer","exp":1600003600,"iat":1600000000,"sub":"test-sub","aud":"test-api","iss":"https://example.com","jti":"test-jti","extra":"value"}`),
+	}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+	c.introspectionURL = "http://example.com/introspect"
+
+	i, err := c.Introspect(context.Background(), "test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Request.Method != "POST" || d.Request.URL.String() != "http://example.com/introspect" {
+		t.Errorf("Wrong request %v %v", d.Request.Method, d.Request.URL)
+	}
+	if id, secret, ok := d.Request.BasicAuth(); !ok || id != "test-id" || secret != "test-secret" {
+		t.Error("Wrong client authentication sent")
+	}
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("token") != "test-token" {
+		t.Error("Wrong token sent")
+	}
+
+	expected := Introspection{
+		Active:    true,
+		Scope:     []string{"openid", "read"},
+		ClientID:  "test-client",
+		Username:  "test-user",
+		TokenType: "Bearer",
+		Expiry:    time.Unix(1600003600, 0).UTC(),
+		IssuedAt:  time.Unix(1600000000, 0).UTC(),
+		Subject:   "test-sub",
+		Audience:  []string{"test-api"},
+		Issuer:    "https://example.com",
+		JWTID:     "test-jti",
+	}
+	claims := i.Claims
+	i.Claims = nil
+	if !reflect.DeepEqual(i, expected) {
+		t.Errorf("Wrong introspection %+v", i)
+	}
+	if claims["extra"] != "value" {
+		t.Errorf("Wrong claims %v", claims)
+	}
+	if !i.HasScope("read") || i.HasScope("write") {
+		t.Errorf("Wrong HasScope for %v", i.Scope)
+	}
+}
+
+func TestOAuth2ClientIntrospectClientSecretPost(t *testing.T) {
+	d := &testDoer{Response: newTestResponse(200, "application/json", `{"active":false}`)}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretPost)
+	c.introspectionURL = "http://example.com/introspect"
+
+	i, err := c.Introspect(context.Background(), "test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Active {
+		t.Error("Inactive token reported active")
+	}
+
+	if _, _, ok := d.Request.BasicAuth(); ok {
+		t.Error("Basic authentication sent")
+	}
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("client_id") != "test-id" || d.Request.PostForm.Get("client_secret") != "test-secret" {
+		t.Error("Wrong client authentication sent")
+	}
+}
+
+func TestOAuth2ClientIntrospectErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		url  string
+		d    *testDoer
+		err  error
+	}{
+		{"unsupported", "", &testDoer{}, ErrUnsupported},
+		{"network error", "http://example.com/introspect", &testDoer{Error: errors.New("test")}, ErrProviderUnavailable},
+		{"server error", "http://example.com/introspect", &testDoer{Response: newTestResponse(503, "text/plain", "unavailable")}, ErrProviderUnavailable},
+		{"invalid client", "http://example.com/introspect", &testDoer{Response: newTestResponse(401, "application/json", `{"error":"invalid_client"}`)}, ErrAuthorization},
+		{"missing active", "http://example.com/introspect", &testDoer{Response: newTestResponse(200, "application/json", `{"sub":"test"}`)}, ErrAuthorization},
+		{"invalid JSON", "http://example.com/introspect", &testDoer{Response: newTestResponse(200, "application/json", `active`)}, ErrAuthorization},
+	}
+	for _, c := range cases {
+		oac := newTestOAuth2Client(c.d, oauth2.AuthMethodClientSecretBasic)
+		oac.introspectionURL = c.url
+
+		if _, err := oac.Introspect(context.Background(), "test-token"); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestIntrospectCache(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	cache := newIntrospectionCache(time.Minute, clock)
+	oac := &testOAC{Introspection: Introspection{Active: true, Subject: "test-sub", Expiry: clock.Now().Add(time.Hour)}}
+
+	for n := 0; n < 2; n++ {
+		i, err := introspect(context.Background(), "test-token", oac, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.Subject != "test-sub" {
+			t.Errorf("Wrong introspection %+v", i)
+		}
+		oac.Token = ""
+	}
+	if oac.Token != "" {
+		t.Error("Cached result not used")
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := introspect(context.Background(), "test-token", oac, cache); err != nil {
+		t.Fatal(err)
+	}
+	if oac.Token != "test-token" {
+		t.Error("Result cached longer than TTL")
+	}
+
+	// The result is not cached past the token expiry.
+	oac.Introspection.Expiry = clock.Now().Add(time.Second)
+	introspect(context.Background(), "other-token", oac, cache)
+	clock.Advance(time.Second)
+	oac.Token = ""
+	introspect(context.Background(), "other-token", oac, cache)
+	if oac.Token != "other-token" {
+		t.Error("Result cached past token expiry")
+	}
+}
+
+func TestIntrospectInactiveNotCached(t *testing.T) {
+	cache := newIntrospectionCache(time.Minute, clockwork.NewFakeClock())
+	oac := &testOAC{}
+
+	introspect(context.Background(), "test-token", oac, cache)
+	oac.Token = ""
+	if _, err := introspect(context.Background(), "test-token", oac, cache); err != nil {
+		t.Fatal(err)
+	}
+	if oac.Token != "test-token" {
+		t.Error("Inactive result cached")
+	}
+}
+
+func TestClientIntrospect(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	var requests int32
+	p.Mux.HandleFunc("/oidc/introspect", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if id, _, _ := r.BasicAuth(); id != "test-id" || r.PostFormValue("token") != "test-token" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"active":true,"sub":"test-sub"}`))
+	})
+	cfg := newTestConfig(p)
+	cfg.IntrospectionCacheTTL = time.Minute
+
+	mc, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	for n := 0; n < 2; n++ {
+		i, err := mc.Introspect("test-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !i.Active || i.Subject != "test-sub" {
+			t.Errorf("Wrong introspection %+v", i)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 introspection request, got %v", requests)
+	}
+}
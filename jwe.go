@@ -0,0 +1,163 @@
+package maas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/coreos/go-oidc/key"
+)
+
+// Content encryption algorithms of JWE (RFC 7518 5.1).
+const (
+	encA128CBCHS256 = "A128CBC-HS256"
+	encA192CBCHS384 = "A192CBC-HS384"
+	encA256CBCHS512 = "A256CBC-HS512"
+	encA128GCM      = "A128GCM"
+	encA192GCM      = "A192GCM"
+	encA256GCM      = "A256GCM"
+)
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+	Zip string `json:"zip"`
+}
+
+// isJWE reports whether `token` is in the JWE compact serialization.
+func isJWE(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// decryptJWE decrypts `token` in the JWE compact serialization (RFC 7516) with the private key `k`.
+// Supported key management algorithms are RSA-OAEP and RSA-OAEP-256,
+// content encryption algorithms are AES-CBC with HMAC-SHA2 and AES-GCM.
+func decryptJWE(token string, k *key.PrivateKey) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("malformed JWE, %d segments", len(parts))
+	}
+	segs := make([][]byte, len(parts))
+	for i, p := range parts {
+		s, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("malformed JWE, unable to decode segment %d: %v", i, err)
+		}
+		segs[i] = s
+	}
+	encryptedKey, iv, ciphertext, tag := segs[1], segs[2], segs[3], segs[4]
+
+	var h jweHeader
+	if err := json.Unmarshal(segs[0], &h); err != nil {
+		return nil, fmt.Errorf("malformed JWE, unable to decode header: %v", err)
+	}
+	if h.Zip != "" {
+		return nil, fmt.Errorf("unsupported JWE compression %q", h.Zip)
+	}
+	if h.Kid != "" && k.KeyID != "" && h.Kid != k.KeyID {
+		return nil, fmt.Errorf("JWE encrypted with unknown key %q", h.Kid)
+	}
+
+	var oaepHash hash.Hash
+	switch h.Alg {
+	case "RSA-OAEP":
+		oaepHash = sha1.New()
+	case "RSA-OAEP-256":
+		oaepHash = sha256.New()
+	default:
+		return nil, fmt.Errorf("unsupported JWE algorithm %q", h.Alg)
+	}
+	cek, err := rsa.DecryptOAEP(oaepHash, nil, k.PrivateKey, encryptedKey, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt JWE content encryption key")
+	}
+
+	aad := []byte(parts[0])
+	switch h.Enc {
+	case encA128CBCHS256:
+		return decryptCBCHMAC(cek, 16, sha256.New, iv, ciphertext, tag, aad)
+	case encA192CBCHS384:
+		return decryptCBCHMAC(cek, 24, sha512.New384, iv, ciphertext, tag, aad)
+	case encA256CBCHS512:
+		return decryptCBCHMAC(cek, 32, sha512.New, iv, ciphertext, tag, aad)
+	case encA128GCM:
+		return decryptGCM(cek, 16, iv, ciphertext, tag, aad)
+	case encA192GCM:
+		return decryptGCM(cek, 24, iv, ciphertext, tag, aad)
+	case encA256GCM:
+		return decryptGCM(cek, 32, iv, ciphertext, tag, aad)
+	default:
+		return nil, fmt.Errorf("unsupported JWE encryption %q", h.Enc)
+	}
+}
+
+// decryptCBCHMAC implements AES_CBC_HMAC_SHA2 decryption (RFC 7518 5.2.2.2).
+func decryptCBCHMAC(cek []byte, keyLen int, newHash func() hash.Hash, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	if len(cek) != 2*keyLen {
+		return nil, errors.New("invalid JWE content encryption key length")
+	}
+	macKey, encKey := cek[:keyLen], cek[keyLen:]
+
+	al := make([]byte, 8)
+	binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+	mac := hmac.New(newHash, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write(al)
+	if subtle.ConstantTimeCompare(mac.Sum(nil)[:keyLen], tag) != 1 {
+		return nil, errors.New("invalid JWE authentication tag")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed JWE ciphertext")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("malformed JWE padding")
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// decryptGCM implements AES GCM decryption (RFC 7518 5.3).
+func decryptGCM(cek []byte, keyLen int, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	if len(cek) != keyLen {
+		return nil, errors.New("invalid JWE content encryption key length")
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, errors.New("malformed JWE initialization vector")
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+	if err != nil {
+		return nil, errors.New("invalid JWE authentication tag")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,144 @@
+package maas
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/key"
+)
+
+// encryptJWE encrypts `plaintext` for `k` with RSA-OAEP-256 and content encryption `enc`.
+func encryptJWE(t *testing.T, k *key.PrivateKey, enc string, plaintext []byte) string {
+	keyLens := map[string]int{
+		encA128CBCHS256: 32, encA192CBCHS384: 48, encA256CBCHS512: 64,
+		encA128GCM: 16, encA192GCM: 24, encA256GCM: 32,
+	}
+	cek := make([]byte, keyLens[enc])
+	rand.Read(cek)
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &k.PrivateKey.PublicKey, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _ := json.Marshal(jweHeader{Alg: "RSA-OAEP-256", Enc: enc, Kid: k.KeyID})
+	rawHeader := base64.RawURLEncoding.EncodeToString(header)
+	aad := []byte(rawHeader)
+
+	var iv, ciphertext, tag []byte
+	if strings.HasSuffix(enc, "GCM") {
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		iv = make([]byte, gcm.NonceSize())
+		rand.Read(iv)
+		sealed := gcm.Seal(nil, iv, plaintext, aad)
+		ciphertext, tag = sealed[:len(plaintext)], sealed[len(plaintext):]
+	} else {
+		newHash := map[string]func() hash.Hash{encA128CBCHS256: sha256.New, encA192CBCHS384: sha512.New384, encA256CBCHS512: sha512.New}[enc]
+		macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+		block, _ := aes.NewCipher(encKey)
+		iv = make([]byte, block.BlockSize())
+		rand.Read(iv)
+		pad := block.BlockSize() - len(plaintext)%block.BlockSize()
+		padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+		ciphertext = make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+		al := make([]byte, 8)
+		binary.BigEndian.PutUint64(al, uint64(len(aad))*8)
+		mac := hmac.New(newHash, macKey)
+		mac.Write(aad)
+		mac.Write(iv)
+		mac.Write(ciphertext)
+		mac.Write(al)
+		tag = mac.Sum(nil)[:len(macKey)]
+	}
+
+	segs := []string{rawHeader}
+	for _, s := range [][]byte{encryptedKey, iv, ciphertext, tag} {
+		segs = append(segs, base64.RawURLEncoding.EncodeToString(s))
+	}
+	return strings.Join(segs, ".")
+}
+
+func newTestPrivateKey(t *testing.T) *key.PrivateKey {
+	k, err := key.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestDecryptJWE(t *testing.T) {
+	k := newTestPrivateKey(t)
+	plaintext := []byte(`{"sub":"test"}`)
+
+	for _, enc := range []string{encA128CBCHS256, encA192CBCHS384, encA256CBCHS512, encA128GCM, encA192GCM, encA256GCM} {
+		token := encryptJWE(t, k, enc, plaintext)
+		if !isJWE(token) {
+			t.Errorf("%v: token not recognized as JWE", enc)
+		}
+
+		decrypted, err := decryptJWE(token, k)
+		if err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%v: wrong plaintext %s", enc, decrypted)
+		}
+	}
+}
+
+func TestDecryptJWETampered(t *testing.T) {
+	k := newTestPrivateKey(t)
+
+	for _, enc := range []string{encA128CBCHS256, encA128GCM} {
+		parts := strings.Split(encryptJWE(t, k, enc, []byte(`{"sub":"test"}`)), ".")
+		ciphertext, _ := base64.RawURLEncoding.DecodeString(parts[3])
+		ciphertext[0] ^= 1
+		parts[3] = base64.RawURLEncoding.EncodeToString(ciphertext)
+
+		if _, err := decryptJWE(strings.Join(parts, "."), k); err == nil {
+			t.Errorf("%v: tampered ciphertext decrypted", enc)
+		}
+	}
+}
+
+func TestDecryptJWEWrongKey(t *testing.T) {
+	k := newTestPrivateKey(t)
+	other := newTestPrivateKey(t)
+	other.KeyID = ""
+
+	if _, err := decryptJWE(encryptJWE(t, k, encA128GCM, []byte("{}")), other); err == nil {
+		t.Error("Decrypted with wrong key")
+	}
+}
+
+func TestDecryptJWEUnsupported(t *testing.T) {
+	k := newTestPrivateKey(t)
+	parts := strings.Split(encryptJWE(t, k, encA128GCM, []byte("{}")), ".")
+
+	for _, h := range []jweHeader{
+		{Alg: "RSA1_5", Enc: encA128GCM},
+		{Alg: "RSA-OAEP-256", Enc: "A128KW"},
+		{Alg: "RSA-OAEP-256", Enc: encA128GCM, Zip: "DEF"},
+	} {
+		header, _ := json.Marshal(h)
+		parts[0] = base64.RawURLEncoding.EncodeToString(header)
+		if _, err := decryptJWE(strings.Join(parts, "."), k); err == nil {
+			t.Errorf("Unsupported JWE %+v decrypted", h)
+		}
+	}
+}
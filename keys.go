@@ -0,0 +1,252 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	phttp "github.com/coreos/go-oidc/http"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+// minKeysRefreshInterval is the minimum time between the fetches of the keys requested with refresh,
+// so tokens signed with unknown keys can't flood the JWKS endpoint.
+const minKeysRefreshInterval = 5 * time.Second
+
+// keySource is a local interface providing the public keys of the authorization server.
+type keySource interface {
+	// Keys returns the public keys. If `refresh` is set, the keys are fetched again even if not expired.
+	Keys(ctx context.Context, refresh bool) ([]key.PublicKey, error)
+}
+
+// remoteKeySet is a `keySource` fetching the keys from the JWKS endpoint of the authorization server
+// and keeping them until they expire.
+type remoteKeySet struct {
+	hc    httpDoer
+	clock clockwork.Clock
+	cache Cache // Optional cache the keys are loaded from before fetching them.
+
+	mu       sync.Mutex
+	endpoint string
+	keys     *key.PublicKeySet
+	fetched  time.Time // Time of the last attempt to fetch the keys.
+}
+
+func newRemoteKeySet(hc httpDoer, endpoint string, clock clockwork.Clock, cache Cache) *remoteKeySet {
+	return &remoteKeySet{
+		hc:       hc,
+		endpoint: endpoint,
+		clock:    clock,
+		cache:    cache,
+	}
+}
+
+// setEndpoint changes the JWKS endpoint, dropping the keys fetched from the previous one.
+func (s *remoteKeySet) setEndpoint(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.endpoint != endpoint {
+		s.endpoint = endpoint
+		s.keys = nil
+	}
+}
+
+// Keys returns the public keys of the authorization server.
+// The lock is not held while the keys are fetched or the cache is accessed,
+// so a slow JWKS endpoint or cache doesn't block the other callers.
+func (s *remoteKeySet) Keys(ctx context.Context, refresh bool) ([]key.PublicKey, error) {
+	if !refresh {
+		s.loadCached(ctx)
+	}
+
+	s.mu.Lock()
+	if !refresh && s.keys != nil && s.clock.Now().Before(s.keys.ExpiresAt()) {
+		defer s.mu.Unlock()
+		return s.keys.Keys(), nil
+	}
+	if refresh && s.keys != nil && s.clock.Now().Before(s.fetched.Add(minKeysRefreshInterval)) {
+		defer s.mu.Unlock()
+		return s.keys.Keys(), nil
+	}
+	endpoint := s.endpoint
+	s.fetched = s.clock.Now()
+	s.mu.Unlock()
+
+	pks, err := fetchPublicKeys(ctx, s.hc, endpoint, s.clock)
+	if err != nil {
+		return nil, newError(ErrProviderUnavailable, err)
+	}
+
+	// Keep the keys only if the endpoint has not been changed in the meantime.
+	s.mu.Lock()
+	current := s.endpoint == endpoint
+	if current {
+		s.keys = pks
+	}
+	s.mu.Unlock()
+
+	if current {
+		storePublicKeys(ctx, s.cache, endpoint, pks)
+	}
+	return pks.Keys(), nil
+}
+
+// loadCached loads the keys from the cache if there are none yet.
+func (s *remoteKeySet) loadCached(ctx context.Context) {
+	s.mu.Lock()
+	endpoint, loaded := s.endpoint, s.keys != nil
+	s.mu.Unlock()
+	if loaded {
+		return
+	}
+
+	pks, ok := loadPublicKeys(ctx, s.cache, endpoint, s.clock)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.endpoint == endpoint && s.keys == nil {
+		s.keys = pks
+	}
+}
+
+// fetchPublicKeys fetches the public keys from JWKS endpoint `endpoint`.
+// The keys expire according to the caching headers of the response or after `oidc.DefaultPublicKeySetTTL`.
+func fetchPublicKeys(ctx context.Context, h httpDoer, endpoint string, clock clockwork.Clock) (*key.PublicKeySet, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keys request failed with status %v", resp.StatusCode)
+	}
+	var ks jwks
+	if err = json.NewDecoder(resp.Body).Decode(&ks); err != nil {
+		return nil, err
+	}
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("zero keys in response")
+	}
+
+	ttl, ok, err := phttp.Cacheable(resp.Header)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		ttl = oidc.DefaultPublicKeySetTTL
+	}
+
+	return key.NewPublicKeySet(ks.Keys, clock.Now().UTC().Add(ttl)), nil
+}
+
+// staticKeySet is a `keySource` returning a fixed set of keys.
+type staticKeySet []key.PublicKey
+
+// Keys returns the keys of the set. They are never refreshed.
+func (s staticKeySet) Keys(ctx context.Context, refresh bool) ([]key.PublicKey, error) {
+	return s, nil
+}
+
+// parseJWKS parses the JSON Web Key Set `data`.
+func parseJWKS(data []byte) (staticKeySet, error) {
+	var ks jwks
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("invalid JWKS: no keys")
+	}
+
+	s := make(staticKeySet, 0, len(ks.Keys))
+	for _, jwk := range ks.Keys {
+		k := key.NewPublicKey(jwk)
+		if _, err := k.Verifier(); err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %v", jwk.ID, err)
+		}
+		s = append(s, *k)
+	}
+	return s, nil
+}
+
+// verifySignature verifies the signature of `jwt` with the keys from `keys`.
+// The keys are fetched again if none of them matches, as the authorization server may have rotated them.
+func verifySignature(ctx context.Context, jwt jose.JWT, keys keySource) error {
+	if alg := jwt.Header[jose.HeaderKeyAlgorithm]; alg != jose.AlgRS256 {
+		return newError(ErrInvalidSignature, fmt.Errorf("unsupported signature algorithm %q", alg))
+	}
+
+	for _, refresh := range []bool{false, true} {
+		ks, err := keys.Keys(ctx, refresh)
+		if err != nil {
+			return err
+		}
+		ok, err := oidc.VerifySignature(jwt, ks)
+		if err != nil {
+			return newError(ErrInvalidSignature, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return newError(ErrInvalidSignature, errors.New("no matching keys"))
+}
+
+// idTokenVerifier is an `oidcClient` verifying the ID tokens with the keys from `keys`.
+type idTokenVerifier struct {
+	issuer   string
+	clientID string
+	keys     keySource
+	clock    clockwork.Clock
+}
+
+// VerifyJWT verifies the signature and the claims of the ID token `jwt`.
+// The keys are fetched again if none of them matches, as the authorization server may have rotated them.
+// Argument `ctx` is used for fetching the keys.
+func (v *idTokenVerifier) VerifyJWT(ctx context.Context, jwt jose.JWT) error {
+	if err := verifySignature(ctx, jwt, v.keys); err != nil {
+		return err
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return newError(ErrMalformedToken, err)
+	}
+
+	if iss, _, _ := claims.StringClaim("iss"); iss != v.issuer {
+		return newError(ErrInvalidIssuer, fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", v.issuer, iss))
+	}
+	if !hasAudience(claims, v.clientID) {
+		return newError(ErrInvalidAudience, fmt.Errorf("invalid claim value: 'aud'. audience=%s not found", v.clientID))
+	}
+	if sub, ok, err := claims.StringClaim("sub"); err != nil || !ok || sub == "" {
+		return newError(ErrInvalidToken, errors.New("missing or invalid claim: 'sub'"))
+	}
+	if _, ok, err := claims.TimeClaim("iat"); err != nil || !ok {
+		return newError(ErrInvalidToken, errors.New("missing or invalid claim: 'iat'"))
+	}
+	exp, ok, err := claims.TimeClaim("exp")
+	if err != nil || !ok {
+		return newError(ErrInvalidToken, errors.New("missing or invalid claim: 'exp'"))
+	}
+	if !v.clock.Now().Before(exp) {
+		return newError(ErrTokenExpired, fmt.Errorf("token is expired, exp=%v", exp))
+	}
+	return nil
+}
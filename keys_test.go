@@ -0,0 +1,256 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+type testKeySource struct {
+	PublicKeys []key.PublicKey
+	Refreshed  []key.PublicKey // Keys returned on refresh. If nil, `PublicKeys` are returned.
+	Calls      int
+	Ctx        context.Context // Context of the last call.
+	Err        error
+}
+
+func (s *testKeySource) Keys(ctx context.Context, refresh bool) ([]key.PublicKey, error) {
+	s.Calls++
+	s.Ctx = ctx
+	if refresh && s.Refreshed != nil {
+		return s.Refreshed, s.Err
+	}
+	return s.PublicKeys, s.Err
+}
+
+func newTestJWKSServer(t *testing.T, keys ...*key.PrivateKey) (*httptest.Server, *int) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		jwks := struct {
+			Keys []jose.JWK `json:"keys"`
+		}{}
+		for _, k := range keys {
+			jwks.Keys = append(jwks.Keys, k.JWK())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	return ts, &requests
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	k := newTestPrivateKey(t)
+	ts, requests := newTestJWKSServer(t, k)
+	defer ts.Close()
+
+	clock := clockwork.NewFakeClock()
+	s := newRemoteKeySet(http.DefaultClient, ts.URL, clock, nil)
+
+	for i := 0; i < 2; i++ {
+		keys, err := s.Keys(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].ID() != k.ID() {
+			t.Errorf("Wrong keys %+v", keys)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("Expected keys to be fetched once, got %v", *requests)
+	}
+
+	if _, err := s.Keys(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 1 {
+		t.Errorf("Expected keys not to be fetched again right after fetch, got %v", *requests)
+	}
+
+	clock.Advance(minKeysRefreshInterval)
+	if _, err := s.Keys(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 2 {
+		t.Errorf("Expected keys to be fetched again on refresh, got %v", *requests)
+	}
+}
+
+func TestRemoteKeySetExpiry(t *testing.T) {
+	k := newTestPrivateKey(t)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		json.NewEncoder(w).Encode(jwks{Keys: []jose.JWK{k.JWK()}})
+	}))
+	defer ts.Close()
+
+	clock := clockwork.NewFakeClock()
+	s := newRemoteKeySet(http.DefaultClient, ts.URL, clock, nil)
+
+	for _, advance := range []time.Duration{0, 59 * time.Second, 2 * time.Second} {
+		clock.Advance(advance)
+		if _, err := s.Keys(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected keys to be fetched again after they expired, got %v requests", requests)
+	}
+	if exp := clock.Now().UTC().Add(60 * time.Second); !s.keys.ExpiresAt().Equal(exp) {
+		t.Errorf("Wrong expiry %v, expected %v", s.keys.ExpiresAt(), exp)
+	}
+}
+
+func TestRemoteKeySetSetEndpointDuringFetch(t *testing.T) {
+	k := newTestPrivateKey(t)
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		json.NewEncoder(w).Encode(jwks{Keys: []jose.JWK{k.JWK()}})
+	}))
+	defer ts.Close()
+
+	s := newRemoteKeySet(http.DefaultClient, ts.URL, clockwork.NewFakeClock(), nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Keys(context.Background(), false)
+		done <- err
+	}()
+
+	<-fetching
+	updated := make(chan struct{})
+	go func() {
+		s.setEndpoint("http://example.com/keys")
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Key set locked during the fetch")
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.keys != nil {
+		t.Error("Keys from the previous endpoint kept")
+	}
+}
+
+func TestRemoteKeySetUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	s := newRemoteKeySet(http.DefaultClient, ts.URL, clockwork.NewRealClock(), nil)
+	if _, err := s.Keys(context.Background(), false); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected ErrProviderUnavailable, got %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	k := newTestPrivateKey(t)
+	jwt := newTestSignedJWT(t, k, jose.Claims{"sub": "test"})
+
+	s := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+	if err := verifySignature(context.Background(), jwt, s); err != nil {
+		t.Error(err)
+	}
+	if s.Calls != 1 {
+		t.Errorf("Expected keys to be retrieved once, got %v", s.Calls)
+	}
+}
+
+func TestVerifySignatureRotatedKeys(t *testing.T) {
+	old := newTestPrivateKey(t)
+	k := newTestPrivateKey(t)
+	jwt := newTestSignedJWT(t, k, jose.Claims{"sub": "test"})
+
+	s := &testKeySource{
+		PublicKeys: []key.PublicKey{*key.NewPublicKey(old.JWK())},
+		Refreshed:  []key.PublicKey{*key.NewPublicKey(k.JWK())},
+	}
+	if err := verifySignature(context.Background(), jwt, s); err != nil {
+		t.Error(err)
+	}
+	if s.Calls != 2 {
+		t.Errorf("Expected keys to be refreshed, got %v calls", s.Calls)
+	}
+}
+
+func TestVerifySignatureInvalid(t *testing.T) {
+	k := newTestPrivateKey(t)
+	other := newTestPrivateKey(t)
+	s := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+
+	if err := verifySignature(context.Background(), newTestSignedJWT(t, other, jose.Claims{"sub": "test"}), s); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for other key, got %v", err)
+	}
+	if err := verifySignature(context.Background(), newTestJWT(t, jose.Claims{"sub": "test"}), s); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for HS256 token, got %v", err)
+	}
+}
+
+func TestIDTokenVerifierContext(t *testing.T) {
+	k := newTestPrivateKey(t)
+	now := time.Now()
+	jwt := newTestSignedJWT(t, k, jose.Claims{
+		"iss": "https://issuer",
+		"aud": "test-id",
+		"sub": "test",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	s := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+	v := &idTokenVerifier{issuer: "https://issuer", clientID: "test-id", keys: s, clock: clockwork.NewRealClock()}
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "test")
+	if err := v.VerifyJWT(ctx, jwt); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ctx == nil || s.Ctx.Value(testContextKey{}) != "test" {
+		t.Error("Context not passed to the key source")
+	}
+}
+
+func TestIDTokenVerifierErrors(t *testing.T) {
+	k := newTestPrivateKey(t)
+	clock := clockwork.NewFakeClock()
+	now := clock.Now()
+	keys := []key.PublicKey{*key.NewPublicKey(k.JWK())}
+
+	cases := []struct {
+		name   string
+		claims jose.Claims
+		keys   *testKeySource
+		kind   error
+	}{
+		{"expired", oidc.NewClaims("https://issuer", "test", "test-id", now.Add(-2*time.Hour), now.Add(-time.Hour)), &testKeySource{PublicKeys: keys}, ErrTokenExpired},
+		{"issuer", oidc.NewClaims("https://other", "test", "test-id", now, now.Add(time.Hour)), &testKeySource{PublicKeys: keys}, ErrInvalidIssuer},
+		{"audience", oidc.NewClaims("https://issuer", "test", "other-id", now, now.Add(time.Hour)), &testKeySource{PublicKeys: keys}, ErrInvalidAudience},
+		{"signature", oidc.NewClaims("https://issuer", "test", "test-id", now, now.Add(time.Hour)), &testKeySource{}, ErrInvalidSignature},
+		{"keys", oidc.NewClaims("https://issuer", "test", "test-id", now, now.Add(time.Hour)), &testKeySource{Err: newError(ErrProviderUnavailable, errors.New("test error"))}, ErrProviderUnavailable},
+		{"subject", oidc.NewClaims("https://issuer", "", "test-id", now, now.Add(time.Hour)), &testKeySource{PublicKeys: keys}, ErrInvalidToken},
+		{"claims", jose.Claims{"iss": "https://issuer", "sub": "test", "aud": "test-id", "exp": now.Add(time.Hour).Unix()}, &testKeySource{PublicKeys: keys}, ErrInvalidToken},
+	}
+
+	for _, c := range cases {
+		v := &idTokenVerifier{issuer: "https://issuer", clientID: "test-id", keys: c.keys, clock: clock}
+		if err := v.VerifyJWT(context.Background(), newTestSignedJWT(t, k, c.claims)); !errors.Is(err, c.kind) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.kind, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GetLogoutURL constructs the URL the browser is redirected to for logging out at the authorization server
+// (OIDC RP-Initiated Logout 1.0). All the arguments are optional and left out if empty.
+// Argument `idTokenHint` is the raw ID token of the user, `postLogoutRedirectURI` is the registered URI
+// the browser is redirected back to after logout and `state` is an opaque value passed back with it.
+// Returns an error matching ErrUnsupported with errors.Is if the provider has no end session endpoint.
+func (mc *client) GetLogoutURL(idTokenHint, postLogoutRedirectURI, state string) (string, error) {
+	return mc.GetLogoutURLContext(context.Background(), idTokenHint, postLogoutRedirectURI, state)
+}
+
+// GetLogoutURLContext constructs the logout URL like `GetLogoutURL`.
+// Argument `ctx` is used for the discovery requests if the client is not initialized yet.
+func (mc *client) GetLogoutURLContext(ctx context.Context, idTokenHint, postLogoutRedirectURI, state string) (string, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return "", err
+	}
+	return getLogoutURL(s.provider.EndSessionEndpoint, mc.config.ClientID, idTokenHint, postLogoutRedirectURI, state)
+}
+
+func getLogoutURL(endSessionEndpoint, clientID, idTokenHint, postLogoutRedirectURI, state string) (string, error) {
+	if endSessionEndpoint == "" {
+		return "", newError(ErrUnsupported, errors.New("no end session endpoint"))
+	}
+	u, err := url.Parse(endSessionEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("client_id", clientID)
+	for name, value := range map[string]string{
+		"id_token_hint":            idTokenHint,
+		"post_logout_redirect_uri": postLogoutRedirectURI,
+		"state":                    state,
+	} {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// NewLogoutURL generates random state, saves it in `store` and returns the logout URL
+// the browser making request `r` should be redirected to for ending the session of token `t`
+// at the authorization server. The ID token of `t`, if any, is sent as the hint.
+func NewLogoutURL(mc Client, store StateStore, w http.ResponseWriter, r *http.Request, t Token, postLogoutRedirectURI string) (string, error) {
+	state, err := NewState()
+	if err != nil {
+		return "", err
+	}
+	if err = store.Save(w, r, state, AuthParams{}); err != nil {
+		return "", err
+	}
+
+	var idTokenHint string
+	if t.IDToken.RawHeader != "" {
+		idTokenHint = t.IDToken.Encode()
+	}
+	return mc.GetLogoutURLContext(r.Context(), idTokenHint, postLogoutRedirectURI, state)
+}
+
+// ValidateLogoutCallback verifies the state of the post logout redirect request `r`
+// against the one saved in `store` by `NewLogoutURL`.
+// Returns ErrInvalidState if the state is not valid for the browser.
+func ValidateLogoutCallback(store StateStore, w http.ResponseWriter, r *http.Request) error {
+	_, err := store.Load(w, r, r.URL.Query().Get("state"))
+	return err
+}
+
+// FrontChannelLogout identifies the session ended at the authorization server by front-channel logout
+// (OIDC Front-Channel Logout 1.0).
+type FrontChannelLogout struct {
+	Issuer    string // Issuer of the logout request (`iss`). Empty if not sent.
+	SessionID string // Session at the authorization server which is ended (`sid`). Empty if not sent, then the session of the browser making the request is ended.
+}
+
+// Matches reports whether session `s` is ended by the logout.
+// Sessions never match a logout without `SessionID`.
+func (l FrontChannelLogout) Matches(s Session) bool {
+	return l.SessionID != "" && l.SessionID == s.Token.SessionID()
+}
+
+// ValidateFrontChannelLogout validates the `iss` and `sid` parameters of a front-channel logout request.
+// Both are required if the provider advertises `frontchannel_logout_session_supported`, otherwise they are optional,
+// but if `sid` is sent, `iss` must be sent as well. If sent, `iss` must be the provider issuer.
+// Returns an error matching ErrInvalidIssuer with errors.Is if it's not.
+func (mc *client) ValidateFrontChannelLogout(iss, sid string) (FrontChannelLogout, error) {
+	return mc.ValidateFrontChannelLogoutContext(context.Background(), iss, sid)
+}
+
+// ValidateFrontChannelLogoutContext validates the parameters of a front-channel logout request like `ValidateFrontChannelLogout`.
+// Argument `ctx` is used for the discovery requests if the client is not initialized yet.
+func (mc *client) ValidateFrontChannelLogoutContext(ctx context.Context, iss, sid string) (FrontChannelLogout, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return FrontChannelLogout{}, err
+	}
+	return validateFrontChannelLogout(iss, sid, s.provider.Issuer.String(), s.provider.FrontChannelLogoutSessionSupported)
+}
+
+func validateFrontChannelLogout(iss, sid, issuer string, sessionSupported bool) (FrontChannelLogout, error) {
+	// A provider sending the parameters always sends them (OIDC Front-Channel Logout 1.0 3),
+	// so a request without them is not from the provider.
+	if sessionSupported && (iss == "" || sid == "") {
+		return FrontChannelLogout{}, newError(ErrInvalidIssuer, errors.New("missing parameters 'iss' and 'sid'"))
+	}
+	if iss == "" && sid != "" {
+		return FrontChannelLogout{}, newError(ErrInvalidIssuer, errors.New("missing parameter 'iss' along with 'sid'"))
+	}
+	if iss != "" && iss != issuer {
+		return FrontChannelLogout{}, newError(ErrInvalidIssuer, fmt.Errorf("invalid parameter value: 'iss'. expected=%s, found=%s", issuer, iss))
+	}
+	return FrontChannelLogout{Issuer: iss, SessionID: sid}, nil
+}
+
+// NewFrontChannelLogoutHandler returns the front-channel logout endpoint of the client
+// (OIDC Front-Channel Logout 1.0), which the authorization server renders in an iframe.
+// It validates the `iss` and `sid` query parameters with `mc.ValidateFrontChannelLogoutContext`
+// and calls `logout` to end the sessions matching `sid`, e.g. with `MemorySessionStore.DeleteMatching`.
+// Requests without `sid` are rejected, as any site could embed them to log the user out.
+// The responses are not cacheable.
+func NewFrontChannelLogoutHandler(mc Client, logout func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error) http.Handler {
+	return frontChannelLogoutHandler(mc, logout, false)
+}
+
+// NewBrowserFrontChannelLogoutHandler returns the front-channel logout endpoint like `NewFrontChannelLogoutHandler`,
+// but also accepts requests without `sid`, for which `logout` has to end the session of the browser making the request.
+// It is meant for the providers which don't send `sid`. Such requests can't be told apart from the ones
+// embedded by another site, so use it only if the session cookies are not sent to other sites (`SameSite`).
+// Note that browsers may not send the session cookies to the iframe of another site,
+// so ending the sessions by `sid` is more reliable.
+func NewBrowserFrontChannelLogoutHandler(mc Client, logout func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error) http.Handler {
+	return frontChannelLogoutHandler(mc, logout, true)
+}
+
+func frontChannelLogoutHandler(mc Client, logout func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error, allowBrowserSession bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// OIDC Front-Channel Logout 1.0 2
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		q := r.URL.Query()
+		if q.Get("sid") == "" && !allowBrowserSession {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		l, err := mc.ValidateFrontChannelLogoutContext(r.Context(), q.Get("iss"), q.Get("sid"))
+		switch {
+		case errors.Is(err, ErrProviderUnavailable), errors.Is(err, ErrClientClosed):
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if err = logout(w, r, l); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,203 @@
+package maas
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+func TestGetLogoutURL(t *testing.T) {
+	u, err := getLogoutURL("https://example.com/logout?x=1", "test-id", "test-id-token", "http://example.com/logout/callback", "test-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lu, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := url.Values{
+		"x":                        {"1"},
+		"client_id":                {"test-id"},
+		"id_token_hint":            {"test-id-token"},
+		"post_logout_redirect_uri": {"http://example.com/logout/callback"},
+		"state":                    {"test-state"},
+	}
+	if lu.Host != "example.com" || lu.Path != "/logout" || lu.Query().Encode() != expected.Encode() {
+		t.Errorf("Wrong logout URL %v", u)
+	}
+
+	u, err = getLogoutURL("https://example.com/logout", "test-id", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://example.com/logout?client_id=test-id" {
+		t.Errorf("Empty parameters not left out: %v", u)
+	}
+
+	if _, err = getLogoutURL("", "test-id", "", "", ""); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestClientGetLogoutURL(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	mc, err := NewClient(newTestConfig(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	u, err := mc.GetLogoutURL("", "", "test-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != p.URL+"/logout?client_id=test-id&state=test-state" {
+		t.Errorf("Wrong logout URL %v", u)
+	}
+
+	if _, err = mc.ValidateFrontChannelLogout(p.URL, "test-sid"); err != nil {
+		t.Error(err)
+	}
+	if _, err = mc.ValidateFrontChannelLogout("https://other.example.com", "test-sid"); !errors.Is(err, ErrInvalidIssuer) {
+		t.Errorf("Expected ErrInvalidIssuer, got %v", err)
+	}
+}
+
+func TestNewLogoutURL(t *testing.T) {
+	mc := &testClient{LogoutURL: "https://example.com/logout"}
+	store := NewMemoryStateStore()
+
+	rec := httptest.NewRecorder()
+	u, err := NewLogoutURL(mc, store, rec, httptest.NewRequest("GET", "/logout", nil), Token{}, "http://example.com/logout/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != mc.LogoutURL || mc.IDTokenHint != "" || mc.PostLogoutRedirectURI != "http://example.com/logout/callback" {
+		t.Errorf("Wrong logout URL %v", u)
+	}
+
+	if err = ValidateLogoutCallback(store, httptest.NewRecorder(), withCookies(rec, "GET", "/logout/callback?state=other")); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState, got %v", err)
+	}
+	if err = ValidateLogoutCallback(store, httptest.NewRecorder(), withCookies(rec, "GET", "/logout/callback?state="+url.QueryEscape(mc.LogoutState))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateFrontChannelLogout(t *testing.T) {
+	cases := []struct {
+		iss, sid         string
+		sessionSupported bool
+		err              error
+	}{
+		{"https://example.com", "test-sid", false, nil},
+		{"https://example.com", "", false, nil},
+		{"", "", false, nil},
+		{"https://other.example.com", "test-sid", false, ErrInvalidIssuer},
+		{"", "test-sid", false, ErrInvalidIssuer},
+		{"https://example.com", "test-sid", true, nil},
+		{"https://example.com", "", true, ErrInvalidIssuer},
+		{"", "", true, ErrInvalidIssuer},
+	}
+	for _, c := range cases {
+		l, err := validateFrontChannelLogout(c.iss, c.sid, "https://example.com", c.sessionSupported)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%q %q %v: expected %v, got %v", c.iss, c.sid, c.sessionSupported, c.err, err)
+		}
+		if err == nil && (l.Issuer != c.iss || l.SessionID != c.sid) {
+			t.Errorf("%q %q: wrong logout %+v", c.iss, c.sid, l)
+		}
+	}
+}
+
+func TestFrontChannelLogoutMatches(t *testing.T) {
+	s := Session{Token: Token{Claims: jose.Claims{"sub": "test-sub", "sid": "test-sid"}}}
+	if !(FrontChannelLogout{SessionID: "test-sid"}).Matches(s) {
+		t.Error("Session with the same sid not matched")
+	}
+	if (FrontChannelLogout{SessionID: "other-sid"}).Matches(s) || (FrontChannelLogout{}).Matches(s) {
+		t.Error("Session with other sid matched")
+	}
+}
+
+func TestFrontChannelLogoutHandler(t *testing.T) {
+	mc := &testClient{}
+	var logouts []FrontChannelLogout
+	h := NewFrontChannelLogoutHandler(mc, func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error {
+		logouts = append(logouts, l)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/frontchannel-logout?iss=https%3A%2F%2Fexample.com&sid=test-sid", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status %v", w.Code)
+	}
+	if w.Header().Get("Cache-Control") != "no-cache, no-store" || w.Header().Get("Pragma") != "no-cache" {
+		t.Errorf("Wrong cache headers %v", w.Header())
+	}
+	if mc.Issuer != "https://example.com" || mc.SessionID != "test-sid" || len(logouts) != 1 || logouts[0].SessionID != "test-sid" {
+		t.Errorf("Wrong logout %+v", logouts)
+	}
+}
+
+func TestFrontChannelLogoutHandlerWithoutSession(t *testing.T) {
+	logout := func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error {
+		if l.SessionID != "" {
+			t.Errorf("Wrong logout %+v", l)
+		}
+		return nil
+	}
+
+	for _, c := range []struct {
+		handler http.Handler
+		status  int
+	}{
+		{NewFrontChannelLogoutHandler(&testClient{}, logout), http.StatusBadRequest},
+		{NewBrowserFrontChannelLogoutHandler(&testClient{}, logout), http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		c.handler.ServeHTTP(w, httptest.NewRequest("GET", "/frontchannel-logout", nil))
+		if w.Code != c.status {
+			t.Errorf("Wrong status %v, expected %v", w.Code, c.status)
+		}
+	}
+}
+
+func TestFrontChannelLogoutHandlerErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		logoutErr error
+		status    int
+	}{
+		{"invalid issuer", newError(ErrInvalidIssuer, errors.New("test")), nil, http.StatusBadRequest},
+		{"provider unavailable", newError(ErrProviderUnavailable, errors.New("test")), nil, http.StatusServiceUnavailable},
+		{"logout failed", nil, errors.New("test"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		mc := &testClient{Err: c.err}
+		h := NewFrontChannelLogoutHandler(mc, func(w http.ResponseWriter, r *http.Request, l FrontChannelLogout) error {
+			if c.err != nil {
+				t.Errorf("%v: logout called", c.name)
+			}
+			return c.logoutErr
+		})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/frontchannel-logout?iss=https%3A%2F%2Fexample.com&sid=test-sid", nil))
+
+		if w.Code != c.status {
+			t.Errorf("%v: wrong status %v", c.name, w.Code)
+		}
+		if w.Header().Get("Cache-Control") != "no-cache, no-store" {
+			t.Errorf("%v: response cacheable", c.name)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package maas
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+const nonceLength = 32
+
+// NonceMismatchError is returned when the `nonce` claim of the ID token
+// doesn't match the nonce sent with the authorization request.
+type NonceMismatchError struct {
+	Expected string // Nonce sent with the authorization request.
+	Actual   string // Nonce found in the ID token. Empty if the claim is missing.
+}
+
+func (e *NonceMismatchError) Error() string {
+	if e.Actual == "" {
+		return "missing claim: 'nonce'"
+	}
+	return fmt.Sprintf("invalid claim value: 'nonce'. expected=%s, found=%s", e.Expected, e.Actual)
+}
+
+// Is reports whether `target` is ErrNonceMismatch.
+func (e *NonceMismatchError) Is(target error) bool {
+	return target == ErrNonceMismatch
+}
+
+// NewNonce generates a new random nonce to be sent with the authorization request.
+// The nonce should be kept by the RP and passed in `AuthParams`
+// both when constructing the authorization request URL and when validating the authorization.
+func NewNonce() (string, error) {
+	return randomString(nonceLength)
+}
+
+// verifyNonce checks that the `nonce` claim of `jwt` matches `nonce`.
+func verifyNonce(jwt jose.JWT, nonce string) error {
+	claims, err := jwt.Claims()
+	if err != nil {
+		return err
+	}
+
+	n, _, err := claims.StringClaim("nonce")
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return &NonceMismatchError{Expected: nonce, Actual: n}
+	}
+
+	return nil
+}
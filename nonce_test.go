@@ -0,0 +1,83 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestJWT(t *testing.T, claims jose.Claims) jose.JWT {
+	jwt, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: jose.AlgHS256}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwt
+}
+
+func TestNewNonce(t *testing.T) {
+	n1, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n1 == "" || n1 == n2 {
+		t.Error("Nonces are not random")
+	}
+}
+
+func TestVerifyNonce(t *testing.T) {
+	cases := []struct {
+		claims jose.Claims
+		valid  bool
+	}{
+		{jose.Claims{"sub": "test", "nonce": "test-nonce"}, true},
+		{jose.Claims{"sub": "test", "nonce": "other-nonce"}, false},
+		{jose.Claims{"sub": "test"}, false},
+	}
+
+	for i, c := range cases {
+		err := verifyNonce(newTestJWT(t, c.claims), "test-nonce")
+		if c.valid && err != nil {
+			t.Errorf("case %v: unexpected error %v", i, err)
+		}
+		if !c.valid {
+			if _, ok := err.(*NonceMismatchError); !ok {
+				t.Errorf("case %v: expected NonceMismatchError, got %#v", i, err)
+			}
+			if !errors.Is(err, ErrNonceMismatch) {
+				t.Errorf("case %v: expected ErrNonceMismatch, got %v", i, err)
+			}
+		}
+	}
+}
+
+func TestValidateAuthNonceMismatch(t *testing.T) {
+	jwt := newTestJWT(t, jose.Claims{"sub": "test", "nonce": "other-nonce"})
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken: "test-ac",
+			IDToken:     jwt.Encode(),
+		},
+	}
+
+	tkn, err := validateAuth(context.Background(), "test-code", AuthParams{Nonce: "test-nonce"}, &testOIDC{}, oac, clockwork.NewFakeClock())
+
+	nerr, ok := err.(*NonceMismatchError)
+	if !ok {
+		t.Fatalf("Expected NonceMismatchError, got %#v", err)
+	}
+	if nerr.Expected != "test-nonce" || nerr.Actual != "other-nonce" {
+		t.Errorf("Wrong error details %+v", nerr)
+	}
+	if tkn.AccessToken != "" {
+		t.Error("Access token returned on nonce mismatch")
+	}
+}
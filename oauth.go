@@ -0,0 +1,243 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+// oauth2Client is an implementation of `oauthClient`, which unlike oauth2.Client
+// allows additional parameters (e.g. PKCE `code_verifier`) to be sent with the token request.
+type oauth2Client struct {
+	oac         *oauth2.Client
+	hc          httpDoer
+	credentials oidc.ClientCredentials
+	redirectURL string
+	scope       []string
+	tokenURL    string
+	authMethod  string
+
+	introspectionURL string // Empty if the provider doesn't support introspection.
+	revocationURL    string // Empty if the provider doesn't support revocation.
+}
+
+func newOAuth2Client(h httpDoer, credentials oidc.ClientCredentials, redirectURL string, scope []string, provider providerConfig) (*oauth2Client, error) {
+	authMethod, err := chooseAuthMethod(provider.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	oac, err := oauth2.NewClient(h, oauth2.Config{
+		Credentials: oauth2.ClientCredentials(credentials),
+		RedirectURL: redirectURL,
+		AuthURL:     provider.AuthEndpoint.String(),
+		TokenURL:    provider.TokenEndpoint.String(),
+		Scope:       scope,
+		AuthMethod:  authMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2Client{
+		oac:         oac,
+		hc:          h,
+		credentials: credentials,
+		redirectURL: redirectURL,
+		scope:       scope,
+		tokenURL:    provider.TokenEndpoint.String(),
+		authMethod:  authMethod,
+
+		introspectionURL: provider.IntrospectionEndpoint,
+		revocationURL:    provider.RevocationEndpoint,
+	}, nil
+}
+
+// chooseAuthMethod selects the first token endpoint authentication method supported by both the provider and the SDK.
+func chooseAuthMethod(provider oidc.ProviderConfig) (string, error) {
+	if len(provider.TokenEndpointAuthMethodsSupported) == 0 {
+		return oauth2.AuthMethodClientSecretBasic, nil
+	}
+
+	for _, authMethod := range provider.TokenEndpointAuthMethodsSupported {
+		if authMethod == oauth2.AuthMethodClientSecretBasic || authMethod == oauth2.AuthMethodClientSecretPost {
+			return authMethod, nil
+		}
+	}
+
+	return "", errors.New("no supported auth methods")
+}
+
+// AuthCodeURL generates the URL for the initial redirect to the authorization server.
+func (c *oauth2Client) AuthCodeURL(state, accessType, prompt string) string {
+	return c.oac.AuthCodeURL(state, accessType, prompt)
+}
+
+// RequestToken requests a token from the token endpoint with the specified `grantType`.
+// Arguments `grantType` and `value` have the same meaning as in oauth2.Client.RequestToken.
+// Argument `params` holds additional parameters to be sent with the request.
+// Argument `ctx` is used for the request.
+func (c *oauth2Client) RequestToken(ctx context.Context, grantType, value string, params url.Values) (result oauth2.TokenResponse, err error) {
+	v := url.Values{
+		"redirect_uri":  {c.redirectURL},
+		"scope":         {strings.Join(c.scope, " ")},
+		"client_id":     {c.credentials.ID},
+		"client_secret": {c.credentials.Secret},
+		"grant_type":    {grantType},
+	}
+	switch grantType {
+	case oauth2.GrantTypeAuthCode:
+		v.Set("code", value)
+	case oauth2.GrantTypeRefreshToken:
+		v.Set("refresh_token", value)
+	default:
+		return result, fmt.Errorf("unsupported grant_type: %v", grantType)
+	}
+	for k, vs := range params {
+		v[k] = vs
+	}
+
+	req, err := c.newAuthenticatedRequest(c.tokenURL, v)
+	if err != nil {
+		return result, err
+	}
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return result, newError(ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	return parseTokenResponse(resp)
+}
+
+// newAuthenticatedRequest creates a POST request of form `v` authenticated with the client credentials.
+func (c *oauth2Client) newAuthenticatedRequest(endpoint string, v url.Values) (*http.Request, error) {
+	if c.authMethod == oauth2.AuthMethodClientSecretPost {
+		v.Set("client_id", c.credentials.ID)
+		v.Set("client_secret", c.credentials.Secret)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	if c.authMethod == oauth2.AuthMethodClientSecretBasic {
+		req.SetBasicAuth(url.QueryEscape(c.credentials.ID), url.QueryEscape(c.credentials.Secret))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return req, nil
+}
+
+// parseTokenResponse parses a token endpoint response the same way oauth2.Client does.
+func parseTokenResponse(resp *http.Response) (result oauth2.TokenResponse, err error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, newError(ErrProviderUnavailable, err)
+	}
+	badStatusCode := resp.StatusCode < 200 || resp.StatusCode > 299
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		if badStatusCode {
+			return result, newResponseError(resp, body, "", "", "")
+		}
+		return result, err
+	}
+
+	result = oauth2.TokenResponse{
+		RawBody: body,
+	}
+
+	if contentType == "application/x-www-form-urlencoded" || contentType == "text/plain" {
+		vals, err := url.ParseQuery(string(body))
+		if err != nil {
+			return result, err
+		}
+		if e := vals.Get("error"); e != "" || badStatusCode {
+			return result, newResponseError(resp, body, e, vals.Get("error_description"), vals.Get("state"))
+		}
+		e := vals.Get("expires_in")
+		if e == "" {
+			e = vals.Get("expires")
+		}
+		if e != "" {
+			if result.Expires, err = strconv.Atoi(e); err != nil {
+				return result, err
+			}
+		}
+		result.AccessToken = vals.Get("access_token")
+		result.TokenType = vals.Get("token_type")
+		result.IDToken = vals.Get("id_token")
+		result.RefreshToken = vals.Get("refresh_token")
+		result.Scope = vals.Get("scope")
+		return result, nil
+	}
+
+	var r struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		IDToken      string `json:"id_token"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+		State        string `json:"state"`
+		ExpiresIn    int    `json:"expires_in"`
+		Expires      int    `json:"expires"`
+		Error        string `json:"error"`
+		Desc         string `json:"error_description"`
+	}
+	if err = json.Unmarshal(body, &r); err != nil {
+		if badStatusCode {
+			return result, newResponseError(resp, body, "", "", "")
+		}
+		return result, err
+	}
+	if r.Error != "" || badStatusCode {
+		return result, newResponseError(resp, body, r.Error, r.Desc, r.State)
+	}
+	result.AccessToken = r.AccessToken
+	result.TokenType = r.TokenType
+	result.IDToken = r.IDToken
+	result.RefreshToken = r.RefreshToken
+	result.Scope = r.Scope
+	result.Expires = r.ExpiresIn
+	if result.Expires == 0 {
+		result.Expires = r.Expires
+	}
+
+	return result, nil
+}
+
+// newResponseError wraps an error response of the authorization server with error code `typ`.
+// Responses without an error code are classified by their status.
+func newResponseError(resp *http.Response, body []byte, typ, desc, state string) error {
+	if typ != "" {
+		return newOAuthError(&oauth2.Error{Type: typ, Description: desc, State: state})
+	}
+	err := fmt.Errorf("unrecognized error %s", body)
+	if resp.StatusCode >= 500 {
+		return newError(ErrProviderUnavailable, err)
+	}
+	return newError(ErrAuthorization, err)
+}
+
+// parseErrorResponse parses the JSON error response of the other OAuth 2.0 endpoints (RFC 6749 5.2).
+func parseErrorResponse(resp *http.Response, body []byte) error {
+	var r struct {
+		Error string `json:"error"`
+		Desc  string `json:"error_description"`
+	}
+	json.Unmarshal(body, &r)
+	return newResponseError(resp, body, r.Error, r.Desc, "")
+}
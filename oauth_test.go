@@ -0,0 +1,146 @@
+package maas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+)
+
+func newTestOAuth2Client(d *testDoer, authMethod string) *oauth2Client {
+	return &oauth2Client{
+		hc:          d,
+		credentials: oidc.ClientCredentials{ID: "test-id", Secret: "test-secret"},
+		redirectURL: "http://example.com/oidc",
+		scope:       []string{"openid", "email"},
+		tokenURL:    "http://example.com/token",
+		authMethod:  authMethod,
+	}
+}
+
+func newTestResponse(status int, contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	d := &testDoer{
+		Response: newTestResponse(200, "application/json", `{"access_token":"test-ac","id_token":"test-id-token","refresh_token":"test-rt","token_type":"Bearer","expires_in":3600}`),
+	}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+
+	tr, err := c.RequestToken(context.Background(), oauth2.GrantTypeAuthCode, "test-code", url.Values{"code_verifier": {"test-verifier"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Request.Method != "POST" {
+		t.Error("Wrong HTTP method sent")
+	}
+	if d.Request.URL.String() != "http://example.com/token" {
+		t.Error("Wrong endpoint used")
+	}
+	if id, secret, ok := d.Request.BasicAuth(); !ok || id != "test-id" || secret != "test-secret" {
+		t.Error("Wrong client authentication sent")
+	}
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("grant_type") != oauth2.GrantTypeAuthCode {
+		t.Error("Wrong grant type sent")
+	}
+	if d.Request.PostForm.Get("code") != "test-code" {
+		t.Error("Wrong code sent")
+	}
+	if d.Request.PostForm.Get("code_verifier") != "test-verifier" {
+		t.Error("Code verifier not sent")
+	}
+
+	if tr.AccessToken != "test-ac" || tr.IDToken != "test-id-token" || tr.RefreshToken != "test-rt" {
+		t.Errorf("Wrong tokens returned: %+v", tr)
+	}
+	if tr.Expires != 3600 {
+		t.Error("Wrong expiration returned")
+	}
+}
+
+func TestRequestTokenClientSecretPost(t *testing.T) {
+	d := &testDoer{
+		Response: newTestResponse(200, "application/x-www-form-urlencoded", "access_token=test-ac&id_token=test-id-token&expires_in=60"),
+	}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretPost)
+
+	tr, err := c.RequestToken(context.Background(), oauth2.GrantTypeRefreshToken, "test-rt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := d.Request.BasicAuth(); ok {
+		t.Error("Unexpected basic authentication sent")
+	}
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("client_secret") != "test-secret" {
+		t.Error("Client secret not sent")
+	}
+	if d.Request.PostForm.Get("refresh_token") != "test-rt" {
+		t.Error("Refresh token not sent")
+	}
+
+	if tr.AccessToken != "test-ac" || tr.Expires != 60 {
+		t.Errorf("Wrong token response: %+v", tr)
+	}
+}
+
+func TestRequestTokenError(t *testing.T) {
+	d := &testDoer{
+		Response: newTestResponse(400, "application/json", `{"error":"invalid_grant","error_description":"bad code"}`),
+	}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+
+	_, err := c.RequestToken(context.Background(), oauth2.GrantTypeAuthCode, "test-code", nil)
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("Expected ErrInvalidGrant, got %v", err)
+	}
+	var oerr *oauth2.Error
+	if !errors.As(err, &oerr) {
+		t.Fatalf("Unexpected error %#v", err)
+	}
+	if oerr.Type != oauth2.ErrorInvalidGrant {
+		t.Errorf("Wrong error type %v", oerr.Type)
+	}
+}
+
+func TestRequestTokenServerError(t *testing.T) {
+	d := &testDoer{
+		Response: newTestResponse(502, "text/html", "<html>Bad Gateway</html>"),
+	}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+
+	_, err := c.RequestToken(context.Background(), oauth2.GrantTypeAuthCode, "test-code", nil)
+	if !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected ErrProviderUnavailable, got %v", err)
+	}
+}
+
+func TestRequestTokenUnsupportedGrantType(t *testing.T) {
+	d := &testDoer{}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+
+	if _, err := c.RequestToken(context.Background(), oauth2.GrantTypeImplicit, "", nil); err == nil {
+		t.Error("Expected error")
+	}
+	if d.Request != nil {
+		t.Error("Unexpected request sent")
+	}
+}
@@ -0,0 +1,36 @@
+package maas
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+const (
+	// CodeChallengeMethodS256 is the PKCE code challenge method used by the SDK (RFC 7636).
+	CodeChallengeMethodS256 = "S256"
+
+	codeVerifierLength = 32
+)
+
+// NewCodeVerifier generates a new random PKCE code verifier (RFC 7636).
+// The verifier should be kept by the RP and passed in `AuthParams`
+// both when constructing the authorization request URL and when validating the authorization.
+func NewCodeVerifier() (string, error) {
+	return randomString(codeVerifierLength)
+}
+
+// CodeChallenge derives the S256 code challenge for a PKCE code verifier.
+func CodeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// randomString returns base64url encoded string of `n` cryptographically random bytes.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,30 @@
+package maas
+
+import "testing"
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636, Appendix B.
+	challenge := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Wrong code challenge %v", challenge)
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	v1, err := NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 7636 requires a verifier between 43 and 128 characters.
+	if len(v1) < 43 || len(v1) > 128 {
+		t.Errorf("Wrong code verifier length %v", len(v1))
+	}
+	if v1 == v2 {
+		t.Error("Code verifiers are not random")
+	}
+}
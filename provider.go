@@ -0,0 +1,106 @@
+package maas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	phttp "github.com/coreos/go-oidc/http"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// providerConfig is the configuration of the authorization server. It extends oidc.ProviderConfig
+// with the metadata of the OAuth 2.0 extensions used by the SDK (RFC 8414 2).
+type providerConfig struct {
+	oidc.ProviderConfig
+	providerMetadata
+}
+
+// providerMetadata holds the provider metadata not included in oidc.ProviderConfig.
+type providerMetadata struct {
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+
+	FrontChannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported,omitempty"` // Whether `iss` and `sid` are sent to the front-channel logout endpoint.
+}
+
+// MarshalJSON encodes the configuration as a discovery document.
+func (p *providerConfig) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(&p.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := json.Marshal(p.providerMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge the two JSON objects.
+	var doc map[string]json.RawMessage
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(metadata, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes and validates a discovery document.
+func (p *providerConfig) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.ProviderConfig); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.providerMetadata)
+}
+
+// userInfoEndpoint returns the UserInfo endpoint, which is optional in the provider metadata (OIDC Discovery 3).
+func (p *providerConfig) userInfoEndpoint() (string, error) {
+	if p.UserInfoEndpoint == nil {
+		return "", newError(ErrUnsupported, errors.New("no userinfo endpoint"))
+	}
+	return p.UserInfoEndpoint.String(), nil
+}
+
+// getProviderConfig fetches the provider configuration from the discovery document of `discoveryURI`
+// (OIDC Discovery 4). Its expiry is set according to the caching headers of the response.
+func getProviderConfig(h httpDoer, discoveryURI string, clock clockwork.Clock) (provider providerConfig, err error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(discoveryURI, "/")+discoveryPath, nil)
+	if err != nil {
+		return provider, err
+	}
+
+	resp, err := h.Do(req)
+	if err != nil {
+		return provider, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return provider, fmt.Errorf("discovery failed with status %v", resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return provider, err
+	}
+
+	ttl, ok, err := phttp.Cacheable(resp.Header)
+	if err != nil {
+		return provider, err
+	}
+	if ok {
+		provider.ExpiresAt = clock.Now().UTC().Add(ttl)
+	}
+
+	// The issuer MUST be identical to the URL used to retrieve the configuration (OIDC Discovery 4.3).
+	if strings.TrimSuffix(provider.Issuer.String(), "/") != strings.TrimSuffix(discoveryURI, "/") {
+		return provider, fmt.Errorf(`"issuer" in config (%v) does not match provided issuer URL (%v)`, provider.Issuer, discoveryURI)
+	}
+
+	return provider, nil
+}
@@ -0,0 +1,72 @@
+package maas
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestGetProviderConfig(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	p := newTestProvider(t)
+	defer p.Close()
+
+	provider, err := getProviderConfig(p.Client(), p.URL+"/", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Issuer.String() != p.URL || provider.IntrospectionEndpoint != p.URL+"/oidc/introspect" {
+		t.Errorf("Wrong provider config %+v", provider)
+	}
+
+	// The metadata not held by oidc.ProviderConfig survives the encoding.
+	data, err := json.Marshal(&provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded providerConfig
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TokenEndpoint.String() != provider.TokenEndpoint.String() || decoded.IntrospectionEndpoint != provider.IntrospectionEndpoint {
+		t.Errorf("Wrong decoded provider config %+v", decoded)
+	}
+}
+
+func TestGetProviderConfigExpiry(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	d := &testDoer{Response: newTestResponse(200, "application/json", testDiscoveryDocument)}
+	d.Response.Header.Set("Cache-Control", "max-age=3600")
+
+	provider, err := getProviderConfig(d, "https://example.com", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.URL.String() != "https://example.com/.well-known/openid-configuration" {
+		t.Errorf("Wrong discovery URL %v", d.Request.URL)
+	}
+	if !provider.ExpiresAt.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("Wrong expiry %v", provider.ExpiresAt)
+	}
+}
+
+func TestGetProviderConfigErrors(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	cases := []struct {
+		name string
+		uri  string
+		resp *http.Response
+	}{
+		{"other issuer", "https://other.example.com", newTestResponse(200, "application/json", testDiscoveryDocument)},
+		{"error status", "https://example.com", newTestResponse(404, "application/json", testDiscoveryDocument)},
+		{"invalid document", "https://example.com", newTestResponse(200, "application/json", `{"issuer":"https://example.com"}`)},
+	}
+	for _, c := range cases {
+		if _, err := getProviderConfig(&testDoer{Response: c.resp}, c.uri, clock); err == nil {
+			t.Errorf("%v: no error", c.name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package maas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+// ClientRegistration is the response of the authorization server to dynamic client registration (RFC 7591 3.2.1).
+// It holds the issued credentials, along with the metadata of the client as registered.
+type ClientRegistration struct {
+	oidc.ClientRegistrationResponse
+
+	hc httpDoer // HTTP client used for the registration.
+}
+
+// Config returns `cfg` with the credentials of the registered client.
+// If `cfg` has no `RedirectURI`, the first registered redirect URI is used.
+func (r *ClientRegistration) Config(cfg Config) Config {
+	cfg.ClientID = r.ClientID
+	cfg.ClientSecret = r.ClientSecret
+	if cfg.RedirectURI == "" && len(r.RedirectURIs) > 0 {
+		cfg.RedirectURI = r.RedirectURIs[0].String()
+	}
+	return cfg
+}
+
+// SecretExpired reports whether the client secret is expired at time `now` (`client_secret_expires_at`).
+// Secrets without expiry never expire.
+func (r *ClientRegistration) SecretExpired(now time.Time) bool {
+	return !r.ClientSecretExpiresAt.IsZero() && !now.Before(r.ClientSecretExpiresAt)
+}
+
+// RegisterClient registers a new client with `metadata` at the registration endpoint of the authorization server
+// (OIDC Dynamic Client Registration 1.0, RFC 7591). The endpoint is discovered from `discoveryURI`.
+// Argument `initialAccessToken` authorizes the registration, if the authorization server requires it.
+// The credentials of the returned `ClientRegistration` can be passed to `NewClient` with its `Config` method.
+// The requests are made with `http.DefaultClient`; use `RegisterClientWithHTTPClient` to change it.
+// Returns an error matching ErrUnsupported with errors.Is if the provider has no registration endpoint
+// and `*Error` wrapping *oauth2.Error if the authorization server rejected the registration.
+// The issued client secret may already be expired, check it with `SecretExpired` before using the credentials.
+func RegisterClient(ctx context.Context, discoveryURI string, metadata oidc.ClientMetadata, initialAccessToken string) (*ClientRegistration, error) {
+	return RegisterClientWithHTTPClient(ctx, http.DefaultClient, discoveryURI, metadata, initialAccessToken)
+}
+
+// RegisterClientWithHTTPClient registers a new client like `RegisterClient`, making the requests,
+// including the later management of the registration, with `hc`.
+func RegisterClientWithHTTPClient(ctx context.Context, hc *http.Client, discoveryURI string, metadata oidc.ClientMetadata, initialAccessToken string) (*ClientRegistration, error) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return registerClient(ctx, hc, discoveryURI, metadata, initialAccessToken, clockwork.NewRealClock())
+}
+
+func registerClient(ctx context.Context, h httpDoer, discoveryURI string, metadata oidc.ClientMetadata, initialAccessToken string, clock clockwork.Clock) (*ClientRegistration, error) {
+	if err := metadata.Valid(); err != nil {
+		return nil, err
+	}
+
+	provider, err := fetchProviderConfig(ctx, h, discoveryURI, RetryPolicy{}, clock)
+	if err != nil {
+		return nil, err
+	}
+	if provider.RegistrationEndpoint == nil {
+		return nil, newError(ErrUnsupported, errors.New("no registration endpoint"))
+	}
+
+	body, err := json.Marshal(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	data, err := sendRegistrationRequest(ctx, h, "POST", provider.RegistrationEndpoint.String(), initialAccessToken, body)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientRegistration(h, data)
+}
+
+// Read retrieves the current configuration of the registered client from the client configuration endpoint (RFC 7592 2.1).
+// The registration can also be restored from the stored `RegistrationClientURI` and `RegistrationAccessToken`,
+// then the requests are made with `http.DefaultClient`.
+// Returns an error matching ErrUnsupported with errors.Is if the registration has no client configuration endpoint.
+func (r *ClientRegistration) Read(ctx context.Context) (*ClientRegistration, error) {
+	return r.manage(ctx, "GET", nil)
+}
+
+// Update replaces the metadata of the registered client with `metadata` (RFC 7592 2.2).
+// The authorization server may issue a new client secret or registration access token,
+// so the returned registration must be used from now on.
+func (r *ClientRegistration) Update(ctx context.Context, metadata oidc.ClientMetadata) (*ClientRegistration, error) {
+	if err := metadata.Valid(); err != nil {
+		return nil, err
+	}
+
+	// The request contains the client credentials along with the metadata.
+	data, err := json.Marshal(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]json.RawMessage
+	if err = json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	credentials, err := json.Marshal(struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{r.ClientID, r.ClientSecret})
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(credentials, &body); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(body); err != nil {
+		return nil, err
+	}
+
+	return r.manage(ctx, "PUT", data)
+}
+
+// Delete deregisters the client (RFC 7592 2.3). Its credentials can't be used anymore.
+func (r *ClientRegistration) Delete(ctx context.Context) error {
+	if r.RegistrationClientURI == "" {
+		return newError(ErrUnsupported, errors.New("no client configuration endpoint"))
+	}
+	_, err := sendRegistrationRequest(ctx, r.httpClient(), "DELETE", r.RegistrationClientURI, r.RegistrationAccessToken, nil)
+	return err
+}
+
+// manage sends a request with `body` to the client configuration endpoint and returns the updated registration.
+// The registration access token and the client configuration endpoint are kept if the response doesn't contain them.
+func (r *ClientRegistration) manage(ctx context.Context, method string, body []byte) (*ClientRegistration, error) {
+	if r.RegistrationClientURI == "" {
+		return nil, newError(ErrUnsupported, errors.New("no client configuration endpoint"))
+	}
+	data, err := sendRegistrationRequest(ctx, r.httpClient(), method, r.RegistrationClientURI, r.RegistrationAccessToken, body)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := parseClientRegistration(r.httpClient(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.RegistrationAccessToken == "" {
+		updated.RegistrationAccessToken = r.RegistrationAccessToken
+	}
+	if updated.RegistrationClientURI == "" {
+		updated.RegistrationClientURI = r.RegistrationClientURI
+	}
+	return updated, nil
+}
+
+func (r *ClientRegistration) httpClient() httpDoer {
+	if r.hc == nil {
+		return http.DefaultClient
+	}
+	return r.hc
+}
+
+// sendRegistrationRequest sends a request with JSON `body` to the registration endpoint or the client configuration endpoint
+// authorized with bearer token `token` and returns the body of the response. Argument `body` can be nil.
+func sendRegistrationRequest(ctx context.Context, h httpDoer, method, endpoint, token string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, newError(ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newError(ErrProviderUnavailable, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseErrorResponse(resp, data)
+	}
+	return data, nil
+}
+
+// parseClientRegistration parses the client information response (RFC 7591 3.2.1).
+func parseClientRegistration(h httpDoer, data []byte) (*ClientRegistration, error) {
+	r := &ClientRegistration{hc: h}
+	if err := json.Unmarshal(data, &r.ClientRegistrationResponse); err != nil {
+		return nil, newError(ErrAuthorization, fmt.Errorf("invalid registration response: %v", err))
+	}
+	return r, nil
+}
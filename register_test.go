@@ -0,0 +1,277 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestClientMetadata() oidc.ClientMetadata {
+	return oidc.ClientMetadata{
+		RedirectURIs: []url.URL{{Scheme: "https", Host: "rp.example.com", Path: "/oidc"}},
+		ClientName:   "test-client",
+	}
+}
+
+func TestRegisterClient(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	p := newTestProvider(t)
+	defer p.Close()
+	var metadata oidc.ClientMetadata
+	p.Mux.HandleFunc("/oidc/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer test-initial-token" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			http.Error(w, `{"error":"invalid_client_metadata"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&oidc.ClientRegistrationResponse{
+			ClientID:                "test-id",
+			ClientSecret:            "test-secret",
+			RegistrationAccessToken: "test-registration-token",
+			RegistrationClientURI:   p.URL + "/oidc/register/test-id",
+			ClientSecretExpiresAt:   clock.Now().Add(time.Hour),
+			ClientMetadata:          metadata,
+		})
+	})
+
+	r, err := registerClient(context.Background(), p.Client(), p.URL, newTestClientMetadata(), "test-initial-token", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ClientName != "test-client" || len(metadata.RedirectURIs) != 1 {
+		t.Errorf("Wrong metadata sent %+v", metadata)
+	}
+	if r.ClientID != "test-id" || r.ClientSecret != "test-secret" || r.RegistrationAccessToken != "test-registration-token" || r.RegistrationClientURI != p.URL+"/oidc/register/test-id" {
+		t.Errorf("Wrong registration %+v", r)
+	}
+
+	cfg := r.Config(Config{DiscoveryURI: p.URL})
+	if cfg.ClientID != "test-id" || cfg.ClientSecret != "test-secret" || cfg.RedirectURI != "https://rp.example.com/oidc" || cfg.DiscoveryURI != p.URL {
+		t.Errorf("Wrong config %+v", cfg)
+	}
+
+	if r.SecretExpired(clock.Now()) {
+		t.Error("Secret expired too early")
+	}
+	if !r.SecretExpired(clock.Now().Add(time.Hour)) {
+		t.Error("Secret not expired")
+	}
+}
+
+func TestRegisterClientErrors(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	p := newTestProvider(t)
+	defer p.Close()
+	var status int
+	var body string
+	p.Mux.HandleFunc("/oidc/register", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		err    error
+	}{
+		{"rejected", 400, `{"error":"invalid_redirect_uri","error_description":"test"}`, ErrAuthorization},
+		{"server error", 500, `internal error`, ErrProviderUnavailable},
+		{"invalid response", 201, `{"client_secret":"test-secret"}`, ErrAuthorization},
+	}
+	for _, c := range cases {
+		status, body = c.status, c.body
+		if _, err := registerClient(context.Background(), p.Client(), p.URL, newTestClientMetadata(), "", clock); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	status, body = 201, `{"client_id":"test-id","client_secret":"test-secret","client_secret_expires_at":1,"redirect_uris":["https://rp.example.com/oidc"]}`
+	r, err := registerClient(context.Background(), p.Client(), p.URL, newTestClientMetadata(), "", clock)
+	if err != nil || r.ClientID != "test-id" || !r.SecretExpired(clock.Now()) {
+		t.Errorf("Wrong registration with expired secret: %+v %v", r, err)
+	}
+
+	status, body = 400, `{"error":"invalid_redirect_uri","error_description":"test"}`
+	_, err = registerClient(context.Background(), p.Client(), p.URL, newTestClientMetadata(), "", clock)
+	var oauthErr *oauth2.Error
+	if !errors.As(err, &oauthErr) || oauthErr.Type != "invalid_redirect_uri" {
+		t.Errorf("Expected *oauth2.Error, got %v", err)
+	}
+
+	if _, err := registerClient(context.Background(), p.Client(), p.URL, oidc.ClientMetadata{}, "", clock); err == nil {
+		t.Error("Invalid metadata registered")
+	}
+}
+
+func TestRegisterClientUnsupported(t *testing.T) {
+	d := &testDoer{Response: newTestResponse(200, "application/json", testDiscoveryDocument)}
+
+	if _, err := registerClient(context.Background(), d, "https://example.com", newTestClientMetadata(), "", clockwork.NewFakeClock()); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+// handleTestRegistration registers a fake client registration endpoint and client configuration endpoint
+// (RFC 7591, RFC 7592) on `p`. The client secret and the registration access token are rotated on update.
+func handleTestRegistration(p *testProvider) {
+	var mu sync.Mutex
+	var client *oidc.ClientRegistrationResponse
+	n := 0
+
+	// respond writes the client information response, holding mu.
+	respond := func(w http.ResponseWriter, status int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(client)
+	}
+
+	p.Mux.HandleFunc("/oidc/register", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var metadata oidc.ClientMetadata
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			http.Error(w, `{"error":"invalid_client_metadata"}`, http.StatusBadRequest)
+			return
+		}
+		client = &oidc.ClientRegistrationResponse{
+			ClientID:                "test-id",
+			ClientSecret:            "test-secret-0",
+			RegistrationAccessToken: "test-registration-token-0",
+			RegistrationClientURI:   p.URL + "/oidc/register/test-id",
+			ClientMetadata:          metadata,
+		}
+		respond(w, http.StatusCreated)
+	})
+	p.Mux.HandleFunc("/oidc/register/test-id", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if client == nil || r.Header.Get("Authorization") != "Bearer "+client.RegistrationAccessToken {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			respond(w, http.StatusOK)
+		case "PUT":
+			var credentials struct {
+				ClientID     string `json:"client_id"`
+				ClientSecret string `json:"client_secret"`
+			}
+			var metadata oidc.ClientMetadata
+			data, _ := ioutil.ReadAll(r.Body)
+			if json.Unmarshal(data, &credentials) != nil || json.Unmarshal(data, &metadata) != nil ||
+				credentials.ClientID != client.ClientID || credentials.ClientSecret != client.ClientSecret {
+				http.Error(w, `{"error":"invalid_client_metadata"}`, http.StatusBadRequest)
+				return
+			}
+			n++
+			client.ClientMetadata = metadata
+			client.ClientSecret = fmt.Sprintf("test-secret-%v", n)
+			client.RegistrationAccessToken = fmt.Sprintf("test-registration-token-%v", n)
+			respond(w, http.StatusOK)
+		case "DELETE":
+			client = nil
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestClientRegistrationManagement(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	handleTestRegistration(p)
+	ctx := context.Background()
+
+	r, err := registerClient(ctx, p.Client(), p.URL, newTestClientMetadata(), "", clockwork.NewFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := r.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.ClientID != "test-id" || read.ClientSecret != "test-secret-0" || read.ClientName != "test-client" || read.RegistrationClientURI != r.RegistrationClientURI {
+		t.Errorf("Wrong registration read %+v", read)
+	}
+
+	metadata := newTestClientMetadata()
+	metadata.RedirectURIs = []url.URL{{Scheme: "https", Host: "rp.example.com", Path: "/oidc/callback"}}
+	updated, err := read.Update(ctx, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ClientSecret != "test-secret-1" || updated.RegistrationAccessToken != "test-registration-token-1" {
+		t.Errorf("Credentials not rotated %+v", updated)
+	}
+	if cfg := updated.Config(Config{}); cfg.ClientSecret != "test-secret-1" || cfg.RedirectURI != "https://rp.example.com/oidc/callback" {
+		t.Errorf("Wrong config %+v", cfg)
+	}
+
+	// The rotated registration access token is required from now on.
+	if _, err = r.Read(ctx); !errors.Is(err, ErrAuthorization) {
+		t.Errorf("Expected ErrAuthorization with the old token, got %v", err)
+	}
+
+	// A registration restored from the stored endpoint and token uses the default HTTP client.
+	restored := &ClientRegistration{}
+	restored.RegistrationClientURI = updated.RegistrationClientURI
+	restored.RegistrationAccessToken = updated.RegistrationAccessToken
+	if read, err = restored.Read(ctx); err != nil || read.ClientSecret != "test-secret-1" {
+		t.Fatalf("Wrong restored registration %+v: %v", read, err)
+	}
+
+	if err = updated.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updated.Read(ctx); !errors.Is(err, ErrAuthorization) {
+		t.Errorf("Expected ErrAuthorization for deleted client, got %v", err)
+	}
+}
+
+func TestClientRegistrationManagementErrors(t *testing.T) {
+	ctx := context.Background()
+	r := &ClientRegistration{hc: &testDoer{}}
+
+	if _, err := r.Read(ctx); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Read: expected ErrUnsupported, got %v", err)
+	}
+	if _, err := r.Update(ctx, newTestClientMetadata()); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Update: expected ErrUnsupported, got %v", err)
+	}
+	if err := r.Delete(ctx); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Delete: expected ErrUnsupported, got %v", err)
+	}
+
+	r.RegistrationClientURI = "https://example.com/register/test-id"
+	if _, err := r.Update(ctx, oidc.ClientMetadata{}); err == nil {
+		t.Error("Invalid metadata sent")
+	}
+
+	r.hc = &testDoer{Error: errors.New("test")}
+	if _, err := r.Read(ctx); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected ErrProviderUnavailable, got %v", err)
+	}
+}
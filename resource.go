@@ -0,0 +1,219 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/jonboulle/clockwork"
+)
+
+// accessTokenType is the type of the JWT access tokens (RFC 9068 2.1).
+const accessTokenType = "at+jwt"
+
+// AccessToken holds the claims of a validated JWT access token received by a resource server.
+type AccessToken struct {
+	Raw      string      // The access token as received.
+	Subject  string      // Subject of the token (`sub`), the user or the client it was issued for. Empty if not present.
+	ClientID string      // Client the token was issued to (`client_id`). Empty if not present.
+	Scope    []string    // Granted scopes (`scope`).
+	Expiry   time.Time   // Expiry of the token (`exp`).
+	Claims   jose.Claims // All the claims of the token.
+}
+
+// HasScope reports whether the token grants `scope`.
+func (t AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scope {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAccessToken validates a JWT access token issued by the authorization server (RFC 9068).
+// The signature is verified with the provider keys and the token must be of type `at+jwt`, issued by the provider
+// for `Config.Audience`, not expired and grant all the `scopes`. ID tokens are rejected.
+// Returns an error matching ErrInsufficientScope with errors.Is if any of the `scopes` is not granted
+// and ErrAudienceRequired if `Config.Audience` is not set.
+func (mc *client) ValidateAccessToken(accessToken string, scopes ...string) (AccessToken, error) {
+	return mc.ValidateAccessTokenContext(context.Background(), accessToken, scopes...)
+}
+
+// ValidateAccessTokenContext validates a JWT access token like `ValidateAccessToken`.
+// Argument `ctx` is used for the requests fetching the provider keys.
+func (mc *client) ValidateAccessTokenContext(ctx context.Context, accessToken string, scopes ...string) (AccessToken, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if mc.config.Audience == "" {
+		return AccessToken{}, ErrAudienceRequired
+	}
+	return validateAccessToken(ctx, accessToken, scopes, s.keys, s.provider.Issuer.String(), mc.config.Audience, mc.config.Clock)
+}
+
+func validateAccessToken(ctx context.Context, accessToken string, scopes []string, keys keySource, issuer, audience string, clock clockwork.Clock) (AccessToken, error) {
+	jwt, err := jose.ParseJWT(accessToken)
+	if err != nil {
+		return AccessToken{}, newError(ErrMalformedToken, err)
+	}
+	if err = verifySignature(ctx, jwt, keys); err != nil {
+		return AccessToken{}, err
+	}
+	// The type distinguishes the access tokens from the other JWTs signed by the provider, e.g. the ID tokens (RFC 9068 4).
+	if typ := strings.ToLower(jwt.Header[jose.HeaderMediaType]); typ != accessTokenType && typ != "application/"+accessTokenType {
+		return AccessToken{}, newError(ErrInvalidToken, fmt.Errorf("invalid token type %q, expected %v", jwt.Header[jose.HeaderMediaType], accessTokenType))
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return AccessToken{}, newError(ErrMalformedToken, err)
+	}
+	for _, c := range []string{"nonce", "at_hash"} {
+		if _, ok := claims[c]; ok {
+			return AccessToken{}, newError(ErrInvalidToken, fmt.Errorf("prohibited claim: '%v'", c))
+		}
+	}
+
+	if iss, _, _ := claims.StringClaim("iss"); iss != issuer {
+		return AccessToken{}, newError(ErrInvalidIssuer, fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", issuer, iss))
+	}
+	if !hasAudience(claims, audience) {
+		return AccessToken{}, newError(ErrInvalidAudience, fmt.Errorf("invalid claim value: 'aud'. audience=%s not found", audience))
+	}
+
+	now := clock.Now()
+	exp, ok, err := claims.TimeClaim("exp")
+	if err != nil || !ok {
+		return AccessToken{}, newError(ErrInvalidToken, errors.New("missing or invalid claim: 'exp'"))
+	}
+	if !now.Before(exp) {
+		return AccessToken{}, newError(ErrTokenExpired, fmt.Errorf("token is expired, exp=%v", exp))
+	}
+	if nbf, ok, err := claims.TimeClaim("nbf"); err != nil {
+		return AccessToken{}, newError(ErrInvalidToken, errors.New("invalid claim: 'nbf'"))
+	} else if ok && now.Before(nbf) {
+		return AccessToken{}, newError(ErrInvalidToken, fmt.Errorf("token is not valid yet, nbf=%v", nbf))
+	}
+
+	t := AccessToken{
+		Raw:    accessToken,
+		Scope:  scopeClaim(claims),
+		Expiry: exp,
+		Claims: claims,
+	}
+	t.Subject, _, _ = claims.StringClaim("sub")
+	t.ClientID, _, _ = claims.StringClaim("client_id")
+
+	for _, scope := range scopes {
+		if !t.HasScope(scope) {
+			return AccessToken{}, newError(ErrInsufficientScope, fmt.Errorf("scope %q not granted", scope))
+		}
+	}
+
+	return t, nil
+}
+
+// scopeClaim returns the scopes of the `scope` claim, which is either a space-separated string or an array.
+func scopeClaim(claims jose.Claims) []string {
+	if scope, ok, err := claims.StringClaim("scope"); err == nil && ok {
+		return strings.Fields(scope)
+	}
+	scopes, _, _ := claims.StringsClaim("scope")
+	return scopes
+}
+
+// RequireAccessToken returns a middleware which allows only requests with a valid bearer access token
+// granting all the `scopes` to reach the next handler. Other requests are rejected with
+// an error response as specified in RFC 6750 3.
+// The `AccessToken` can be retrieved from the request context with `AccessTokenFromContext`.
+func RequireAccessToken(mc Client, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accessToken, err := bearerToken(r)
+			if err != nil {
+				writeBearerError(w, http.StatusBadRequest, BearerErrorInvalidRequest, err.Error(), "")
+				return
+			}
+			if accessToken == "" {
+				writeBearerError(w, http.StatusUnauthorized, "", "", "")
+				return
+			}
+
+			t, err := mc.ValidateAccessTokenContext(r.Context(), accessToken, scopes...)
+			switch {
+			case err == nil:
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessTokenContextKey, t)))
+			case errors.Is(err, ErrInsufficientScope):
+				writeBearerError(w, http.StatusForbidden, BearerErrorInsufficientScope, "The access token doesn't grant the required scope", strings.Join(scopes, " "))
+			case errors.Is(err, ErrProviderUnavailable), errors.Is(err, ErrClientClosed):
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			case errors.Is(err, ErrAudienceRequired):
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			default:
+				writeBearerError(w, http.StatusUnauthorized, BearerErrorInvalidToken, invalidTokenDescription("access token", err), "")
+			}
+		})
+	}
+}
+
+// AccessTokenFromContext returns the `AccessToken` placed in the context by `RequireAccessToken`.
+func AccessTokenFromContext(ctx context.Context) (AccessToken, bool) {
+	t, ok := ctx.Value(accessTokenContextKey).(AccessToken)
+	return t, ok
+}
+
+// bearerToken returns the bearer token from the `Authorization` header of `r` (RFC 6750 2.1)
+// or an empty string if there is none.
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", nil
+	}
+	if len(r.Header["Authorization"]) > 1 {
+		return "", errors.New("multiple authorization headers")
+	}
+	parts := strings.SplitN(auth, " ", 2)
+	if !strings.EqualFold(parts[0], "Bearer") {
+		return "", nil
+	}
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", errors.New("missing bearer token")
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+// invalidTokenDescription returns a description of the validation error `err` of token `name`
+// safe to be sent to the client.
+func invalidTokenDescription(name string, err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return "The " + name + " is invalid: " + e.Kind.Error()
+	}
+	return "The " + name + " is invalid"
+}
+
+// writeBearerError writes an error response with the `WWW-Authenticate` challenge of RFC 6750 3.
+// Empty `code`, `description` and `scope` are left out of the challenge.
+func writeBearerError(w http.ResponseWriter, status int, code, description, scope string) {
+	challenge := "Bearer"
+	sep := " "
+	for _, attr := range []struct{ name, value string }{
+		{"error", code},
+		{"error_description", description},
+		{"scope", scope},
+	} {
+		if attr.value != "" {
+			challenge += sep + attr.name + `="` + attr.value + `"`
+			sep = ", "
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+}
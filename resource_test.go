@@ -0,0 +1,231 @@
+package maas
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestAccessTokenClaims(clock clockwork.Clock) jose.Claims {
+	return jose.Claims{
+		"iss":       "https://example.com",
+		"sub":       "test-sub",
+		"aud":       "test-api",
+		"client_id": "test-id",
+		"scope":     "openid read write",
+		"iat":       clock.Now().Unix(),
+		"exp":       clock.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func newTestAccessToken(t *testing.T, k *key.PrivateKey, claims jose.Claims) string {
+	return newTestTypedJWT(t, k, "at+jwt", claims)
+}
+
+// newTestTypedJWT returns a JWT with `claims` signed with `k` and with header `typ` set to `typ`.
+func newTestTypedJWT(t *testing.T, k *key.PrivateKey, typ string, claims jose.Claims) string {
+	s := k.Signer()
+	jwt, err := jose.NewJWT(jose.JOSEHeader{jose.HeaderKeyAlgorithm: s.Alg(), jose.HeaderKeyID: s.ID()}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NewJWT always sets the type to `JWT`.
+	jwt.Header[jose.HeaderMediaType] = typ
+	if typ == "" {
+		delete(jwt.Header, jose.HeaderMediaType)
+	}
+	header, err := json.Marshal(jwt.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt.RawHeader = base64.RawURLEncoding.EncodeToString(header)
+	if jwt.Signature, err = s.Sign([]byte(jwt.Data())); err != nil {
+		t.Fatal(err)
+	}
+	return jwt.Encode()
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+	raw := newTestAccessToken(t, k, newTestAccessTokenClaims(clock))
+
+	at, err := validateAccessToken(context.Background(), raw, []string{"read", "write"}, keys, "https://example.com", "test-api", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at.Raw != raw || at.Subject != "test-sub" || at.ClientID != "test-id" || !at.Expiry.Equal(clock.Now().Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("Wrong access token %+v", at)
+	}
+	if !reflect.DeepEqual(at.Scope, []string{"openid", "read", "write"}) {
+		t.Errorf("Wrong scope %v", at.Scope)
+	}
+	if !at.HasScope("read") || at.HasScope("admin") {
+		t.Errorf("Wrong HasScope for %v", at.Scope)
+	}
+}
+
+func TestValidateAccessTokenScopeArray(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+	claims := newTestAccessTokenClaims(clock)
+	claims["scope"] = []string{"read", "write"}
+	claims["aud"] = []string{"other-api", "test-api"}
+
+	at, err := validateAccessToken(context.Background(), newTestAccessToken(t, k, claims), []string{"write"}, keys, "https://example.com", "test-api", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(at.Scope, []string{"read", "write"}) {
+		t.Errorf("Wrong scope %v", at.Scope)
+	}
+}
+
+func TestValidateAccessTokenInvalid(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	other := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+
+	cases := []struct {
+		name   string
+		key    *key.PrivateKey
+		modify func(jose.Claims)
+		scopes []string
+		err    error
+	}{
+		{"other key", other, func(c jose.Claims) {}, nil, ErrInvalidSignature},
+		{"wrong issuer", k, func(c jose.Claims) { c["iss"] = "https://other.example.com" }, nil, ErrInvalidIssuer},
+		{"wrong audience", k, func(c jose.Claims) { c["aud"] = "other-api" }, nil, ErrInvalidAudience},
+		{"no audience", k, func(c jose.Claims) { delete(c, "aud") }, nil, ErrInvalidAudience},
+		{"expired", k, func(c jose.Claims) { c["exp"] = clock.Now().Unix() }, nil, ErrTokenExpired},
+		{"no expiry", k, func(c jose.Claims) { delete(c, "exp") }, nil, ErrInvalidToken},
+		{"not valid yet", k, func(c jose.Claims) { c["nbf"] = clock.Now().Add(time.Minute).Unix() }, nil, ErrInvalidToken},
+		{"nonce", k, func(c jose.Claims) { c["nonce"] = "test-nonce" }, nil, ErrInvalidToken},
+		{"at_hash", k, func(c jose.Claims) { c["at_hash"] = "test-hash" }, nil, ErrInvalidToken},
+		{"insufficient scope", k, func(c jose.Claims) {}, []string{"read", "admin"}, ErrInsufficientScope},
+		{"no scope", k, func(c jose.Claims) { delete(c, "scope") }, []string{"read"}, ErrInsufficientScope},
+	}
+	for _, c := range cases {
+		claims := newTestAccessTokenClaims(clock)
+		c.modify(claims)
+		raw := newTestAccessToken(t, c.key, claims)
+
+		if _, err := validateAccessToken(context.Background(), raw, c.scopes, keys, "https://example.com", "test-api", clock); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if _, err := validateAccessToken(context.Background(), "not-a-jwt", nil, keys, "https://example.com", "test-api", clock); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("Expected ErrMalformedToken, got %v", err)
+	}
+}
+
+func TestValidateAccessTokenType(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	k := newTestPrivateKey(t)
+	keys := &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}}
+	claims := newTestAccessTokenClaims(clock)
+
+	for typ, valid := range map[string]bool{"at+jwt": true, "application/at+jwt": true, "AT+JWT": true, "JWT": false, "": false} {
+		_, err := validateAccessToken(context.Background(), newTestTypedJWT(t, k, typ, claims), nil, keys, "https://example.com", "test-api", clock)
+		if valid && err != nil {
+			t.Errorf("Type %q rejected: %v", typ, err)
+		}
+		if !valid && !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Type %q: expected ErrInvalidToken, got %v", typ, err)
+		}
+	}
+
+	// An ID token issued to the resource server as a client is not an access token.
+	idToken := newTestSignedJWT(t, k, claims)
+	if _, err := validateAccessToken(context.Background(), idToken.Encode(), nil, keys, "https://example.com", "test-api", clock); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ID token accepted as access token: %v", err)
+	}
+}
+
+func TestValidateAccessTokenNoAudience(t *testing.T) {
+	p := newTestProvider(t, newTestPrivateKey(t))
+	defer p.Close()
+	mc, err := NewClient(newTestConfig(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	if _, err = mc.ValidateAccessToken("test-token"); err != ErrAudienceRequired {
+		t.Errorf("Expected ErrAudienceRequired, got %v", err)
+	}
+}
+
+func TestRequireAccessToken(t *testing.T) {
+	mc := &testClient{ValidToken: AccessToken{Subject: "test-sub"}}
+	var got AccessToken
+	h := RequireAccessToken(mc, "read", "write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = AccessTokenFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status %v", w.Code)
+	}
+	if mc.AccessToken != "test-token" || !reflect.DeepEqual(mc.Scopes, []string{"read", "write"}) {
+		t.Errorf("Wrong validation of %v for %v", mc.AccessToken, mc.Scopes)
+	}
+	if got.Subject != "test-sub" {
+		t.Errorf("Wrong access token in context %+v", got)
+	}
+}
+
+func TestRequireAccessTokenErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    []string
+		err       error
+		status    int
+		challenge string
+	}{
+		{"no token", nil, nil, 401, `Bearer`},
+		{"other scheme", []string{"Basic dGVzdDp0ZXN0"}, nil, 401, `Bearer`},
+		{"empty token", []string{"Bearer "}, nil, 400, `Bearer error="invalid_request", error_description="missing bearer token"`},
+		{"multiple headers", []string{"Bearer a", "Bearer b"}, nil, 400, `Bearer error="invalid_request", error_description="multiple authorization headers"`},
+		{"invalid token", []string{"Bearer test-token"}, newError(ErrTokenExpired, errors.New("test")), 401, `Bearer error="invalid_token", error_description="The access token is invalid: token expired"`},
+		{"insufficient scope", []string{"Bearer test-token"}, newError(ErrInsufficientScope, errors.New("test")), 403, `Bearer error="insufficient_scope", error_description="The access token doesn't grant the required scope", scope="read"`},
+		{"provider unavailable", []string{"Bearer test-token"}, newError(ErrProviderUnavailable, errors.New("test")), 503, ""},
+		{"no audience", []string{"Bearer test-token"}, ErrAudienceRequired, 500, ""},
+	}
+	for _, c := range cases {
+		mc := &testClient{Err: c.err}
+		h := RequireAccessToken(mc, "read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%v: request passed", c.name)
+		}))
+
+		r := httptest.NewRequest("GET", "/api", nil)
+		r.Header["Authorization"] = c.header
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%v: wrong status %v", c.name, w.Code)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); challenge != c.challenge {
+			t.Errorf("%v: wrong challenge %q", c.name, challenge)
+		}
+	}
+}
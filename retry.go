@@ -0,0 +1,174 @@
+package maas
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// RetryPolicy configures retrying of the requests to the authorization server.
+// The delay before retry n (counting from 0) is `BaseDelay * 2^n`, capped at `MaxDelay`
+// and randomized by `Jitter`.
+type RetryPolicy struct {
+	MaxRetries     int                                       // Maximum number of retries. Zero means no retries.
+	BaseDelay      time.Duration                             // Delay before the first retry.
+	MaxDelay       time.Duration                             // Maximum delay between retries. If left out, the delay is not capped.
+	Jitter         float64                                   // Randomization factor between 0 and 1. The delay is picked randomly from [delay*(1-Jitter), delay].
+	MaxElapsedTime time.Duration                             // Maximum time from the first request after which no more retries are made. If left out, there is no limit.
+	Retryable      func(resp *http.Response, err error) bool // Reports whether a request should be retried. If left out, `DefaultRetryable` is used.
+}
+
+// DefaultRetryable reports whether a request should be retried. It retries the requests
+// failed because of a network error and the ones rejected with a status code
+// indicating a temporary failure (429, 502, 503 and 504).
+func DefaultRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// delay returns the delay before retry `n`, counting from 0.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < n && d < math.MaxInt64/2 && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// idempotent reports whether repeating `req` has the same effect as making it once (RFC 7231 4.2.2).
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// notProcessed reports whether a failed request has certainly not been processed by the server,
+// i.e. the connection could not be established or the server refused to handle the request (429 and 503).
+func notProcessed(resp *http.Response, err error) bool {
+	if err != nil {
+		var oerr *net.OpError
+		return errors.As(err, &oerr) && oerr.Op == "dial"
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryable reports whether a request should be retried according to the policy.
+func (p RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(resp, err)
+	}
+	return p.Retryable(resp, err)
+}
+
+// discoveryRetryPolicy returns the retry policy for the provider discovery.
+// Unless `RetryPolicy` is set, `ProviderRetries` retries are made with fixed delay after any failure.
+func discoveryRetryPolicy(cfg Config) RetryPolicy {
+	if cfg.RetryPolicy != nil {
+		return *cfg.RetryPolicy
+	}
+	return RetryPolicy{
+		MaxRetries: cfg.ProviderRetries,
+		BaseDelay:  sleepPeriod,
+		MaxDelay:   sleepPeriod,
+		Retryable:  retryAny,
+	}
+}
+
+// retryAny retries every failure, as `ProviderRetries` always has.
+func retryAny(resp *http.Response, err error) bool {
+	return true
+}
+
+// retryDoer is a `httpDoer` retrying the requests according to a `RetryPolicy`.
+// Retries are aborted when the context of the request is done.
+// Non-idempotent requests (e.g. the token requests, which must not redeem an authorization code
+// or a refresh token twice) are retried only if they have certainly not been processed.
+type retryDoer struct {
+	h      httpDoer
+	policy RetryPolicy
+	clock  clockwork.Clock
+}
+
+func newRetryDoer(h httpDoer, policy RetryPolicy, clock clockwork.Clock) *retryDoer {
+	return &retryDoer{
+		h:      h,
+		policy: policy,
+		clock:  clock,
+	}
+}
+
+func (d *retryDoer) Do(req *http.Request) (*http.Response, error) {
+	start := d.clock.Now()
+	ctx := req.Context()
+
+	for n := 0; ; n++ {
+		resp, err := d.h.Do(req)
+		if n >= d.policy.MaxRetries || ctx.Err() != nil || !d.policy.retryable(resp, err) {
+			return resp, err
+		}
+		if !idempotent(req) && !notProcessed(resp, err) {
+			return resp, err
+		}
+		// The request body has been consumed, so it can be retried only if it can be recreated.
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+
+		delay := d.policy.delay(n)
+		if d.policy.MaxElapsedTime > 0 && d.clock.Now().Add(delay).Sub(start) > d.policy.MaxElapsedTime {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.clock.After(delay):
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// recordingDoer is a `httpDoer` keeping the outcome of the last request
+// so that it can be classified by `RetryPolicy.Retryable`.
+type recordingDoer struct {
+	h    httpDoer
+	resp *http.Response
+	err  error
+}
+
+func (d *recordingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.resp, d.err = d.h.Do(req)
+	return d.resp, d.err
+}
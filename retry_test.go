@@ -0,0 +1,311 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// testSeqDoer returns `Responses` in sequence, failing with `Err` once they run out.
+type testSeqDoer struct {
+	Responses []*http.Response
+	Err       error
+	Bodies    []string // Bodies of the requests made.
+}
+
+func (d *testSeqDoer) Do(rq *http.Request) (*http.Response, error) {
+	body := ""
+	if rq.Body != nil {
+		b, _ := ioutil.ReadAll(rq.Body)
+		body = string(b)
+	}
+	d.Bodies = append(d.Bodies, body)
+
+	if len(d.Responses) == 0 {
+		return nil, d.Err
+	}
+	resp := d.Responses[0]
+	d.Responses = d.Responses[1:]
+	return resp, nil
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for n, e := range expected {
+		if d := p.delay(n); d != e {
+			t.Errorf("Wrong delay %v for retry %v, expected %v", d, n, e)
+		}
+	}
+
+	if d := (RetryPolicy{BaseDelay: time.Second}).delay(100); d <= 0 {
+		t.Errorf("Delay overflow %v", d)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < time.Second || d > 2*time.Second {
+			t.Fatalf("Delay %v out of jitter range", d)
+		}
+	}
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	cases := map[int]bool{200: false, 400: false, 401: false, 500: false, 429: true, 502: true, 503: true, 504: true}
+	for status, retryable := range cases {
+		if DefaultRetryable(&http.Response{StatusCode: status}, nil) != retryable {
+			t.Errorf("Wrong classification of status %v", status)
+		}
+	}
+	if !DefaultRetryable(nil, errors.New("test error")) {
+		t.Error("Network error not retryable")
+	}
+}
+
+// doAsync runs `d.Do(req)` in background.
+func doAsync(d httpDoer, req *http.Request) chan *http.Response {
+	c := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := d.Do(req)
+		c <- resp
+	}()
+	return c
+}
+
+func TestRetryDoer(t *testing.T) {
+	sd := &testSeqDoer{Responses: []*http.Response{
+		newTestResponse(503, "text/plain", ""),
+		newTestResponse(429, "text/plain", ""),
+		newTestResponse(200, "text/plain", "ok"),
+	}}
+	clock := clockwork.NewFakeClock()
+	d := newRetryDoer(sd, RetryPolicy{MaxRetries: 3, BaseDelay: time.Second}, clock)
+
+	req, _ := http.NewRequest("POST", "http://example.com/token", strings.NewReader("grant_type=test"))
+	done := doAsync(d, req)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+		t.Fatal("Second retry made before the backoff delay")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+
+	resp := <-done
+	if resp == nil || resp.StatusCode != 200 {
+		t.Fatalf("Wrong response %+v", resp)
+	}
+	if len(sd.Bodies) != 3 {
+		t.Fatalf("Expected 3 attempts, got %v", len(sd.Bodies))
+	}
+	for _, b := range sd.Bodies {
+		if b != "grant_type=test" {
+			t.Errorf("Wrong body %q sent on retry", b)
+		}
+	}
+}
+
+func TestRetryDoerNotRetryable(t *testing.T) {
+	sd := &testSeqDoer{Responses: []*http.Response{newTestResponse(400, "text/plain", "")}}
+	d := newRetryDoer(sd, RetryPolicy{MaxRetries: 3, BaseDelay: time.Second}, clockwork.NewFakeClock())
+
+	req, _ := http.NewRequest("GET", "http://example.com/userinfo", nil)
+	resp, err := d.Do(req)
+	if err != nil || resp.StatusCode != 400 {
+		t.Errorf("Wrong response %+v %v", resp, err)
+	}
+	if len(sd.Bodies) != 1 {
+		t.Errorf("Expected 1 attempt, got %v", len(sd.Bodies))
+	}
+}
+
+func TestRetryDoerNonIdempotent(t *testing.T) {
+	cases := map[string]struct {
+		Doer     *testSeqDoer
+		Attempts int
+	}{
+		"bad gateway":     {&testSeqDoer{Responses: []*http.Response{newTestResponse(502, "text/plain", ""), newTestResponse(200, "text/plain", "")}}, 1},
+		"gateway timeout": {&testSeqDoer{Responses: []*http.Response{newTestResponse(504, "text/plain", ""), newTestResponse(200, "text/plain", "")}}, 1},
+		"network error":   {&testSeqDoer{Err: errors.New("connection reset")}, 1},
+		"not connected":   {&testSeqDoer{Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, 2},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			clock := clockwork.NewFakeClock()
+			d := newRetryDoer(c.Doer, RetryPolicy{MaxRetries: 1, BaseDelay: time.Second}, clock)
+
+			req, _ := http.NewRequest("POST", "http://example.com/token", strings.NewReader("grant_type=authorization_code&code=test-code"))
+			done := doAsync(d, req)
+			if c.Attempts > 1 {
+				clock.BlockUntil(1)
+				clock.Advance(time.Second)
+			}
+			<-done
+
+			if len(c.Doer.Bodies) != c.Attempts {
+				t.Errorf("Expected %v attempts, got %v", c.Attempts, len(c.Doer.Bodies))
+			}
+		})
+	}
+}
+
+func TestRetryDoerMaxRetries(t *testing.T) {
+	sd := &testSeqDoer{Err: errors.New("test error")}
+	clock := clockwork.NewFakeClock()
+	d := newRetryDoer(sd, RetryPolicy{MaxRetries: 1, BaseDelay: time.Second}, clock)
+
+	req, _ := http.NewRequest("GET", "http://example.com/userinfo", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Do(req)
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	if err := <-done; err != sd.Err {
+		t.Errorf("Expected last error, got %v", err)
+	}
+	if len(sd.Bodies) != 2 {
+		t.Errorf("Expected 2 attempts, got %v", len(sd.Bodies))
+	}
+}
+
+func TestRetryDoerMaxElapsedTime(t *testing.T) {
+	sd := &testSeqDoer{Err: errors.New("test error")}
+	d := newRetryDoer(sd, RetryPolicy{MaxRetries: 10, BaseDelay: time.Minute, MaxElapsedTime: 30 * time.Second}, clockwork.NewFakeClock())
+
+	req, _ := http.NewRequest("GET", "http://example.com/userinfo", nil)
+	if _, err := d.Do(req); err != sd.Err {
+		t.Errorf("Expected error, got %v", err)
+	}
+	if len(sd.Bodies) != 1 {
+		t.Errorf("Expected no retries after max elapsed time, got %v attempts", len(sd.Bodies))
+	}
+}
+
+func TestRetryDoerCanceled(t *testing.T) {
+	sd := &testSeqDoer{Err: errors.New("test error")}
+	clock := clockwork.NewFakeClock()
+	d := newRetryDoer(sd, RetryPolicy{MaxRetries: 10, BaseDelay: time.Second}, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "http://example.com/userinfo", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Do(req.WithContext(ctx))
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if len(sd.Bodies) != 1 {
+		t.Errorf("Expected 1 attempt, got %v", len(sd.Bodies))
+	}
+}
+
+func TestFetchProviderConfigNotRetryable(t *testing.T) {
+	cases := map[string]http.HandlerFunc{
+		"not found": func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		},
+		"malformed": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{"))
+		},
+	}
+
+	for name, h := range cases {
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				h(w, r)
+			}))
+			defer ts.Close()
+
+			policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Second}
+			_, err := fetchProviderConfig(context.Background(), http.DefaultClient, ts.URL, policy, clockwork.NewFakeClock())
+			if !errors.Is(err, ErrProviderUnavailable) {
+				t.Errorf("Expected ErrProviderUnavailable, got %v", err)
+			}
+			if requests != 1 {
+				t.Errorf("Expected 1 request, got %v", requests)
+			}
+		})
+	}
+}
+
+func TestFetchProviderConfigProviderRetries(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	clock := clockwork.NewFakeClock()
+	policy := discoveryRetryPolicy(Config{ProviderRetries: 3})
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetchProviderConfig(context.Background(), http.DefaultClient, ts.URL, policy, clock)
+		done <- err
+	}()
+	for i := 0; i < 3; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(sleepPeriod)
+	}
+
+	if err := <-done; !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("Expected ErrProviderUnavailable, got %v", err)
+	}
+	if requests != 4 {
+		t.Errorf("Expected 4 requests, got %v", requests)
+	}
+}
+
+func TestNewClientRetryPolicy(t *testing.T) {
+	p := newTestProvider(t, newTestPrivateKey(t))
+	defer p.Close()
+	p.SetAvailable(false)
+	clock := clockwork.NewFakeClock()
+	cfg := newTestConfig(p)
+	cfg.Clock = clock
+	cfg.RetryPolicy = &RetryPolicy{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	done := make(chan error, 1)
+	go func() {
+		mc, err := NewClient(cfg)
+		if err == nil {
+			mc.Close()
+		}
+		done <- err
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	p.SetAvailable(true)
+	clock.Advance(2 * time.Second)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Token type hints for `RevokeToken` (RFC 7009 2.1).
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// RevokeToken revokes `token` at the authorization server (RFC 7009).
+// Argument `hint` is the type of the token, `TokenTypeHintAccessToken` or `TokenTypeHintRefreshToken`,
+// and can be left empty. Revoking a refresh token usually revokes the access tokens issued with it as well.
+// The request is authenticated with the client credentials of `Config`.
+// Returns an error matching ErrUnsupported with errors.Is if the provider has no revocation endpoint.
+func (mc *client) RevokeToken(token, hint string) error {
+	return mc.RevokeTokenContext(context.Background(), token, hint)
+}
+
+// RevokeTokenContext revokes `token` like `RevokeToken`.
+// Argument `ctx` is used for the revocation request.
+func (mc *client) RevokeTokenContext(ctx context.Context, token, hint string) error {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return err
+	}
+	if err = s.oauth.RevokeToken(ctx, token, hint); err != nil {
+		return err
+	}
+	mc.introspections.delete(token)
+	return nil
+}
+
+// RevokeToken sends `token` to the revocation endpoint.
+func (c *oauth2Client) RevokeToken(ctx context.Context, token, hint string) error {
+	if c.revocationURL == "" {
+		return newError(ErrUnsupported, errors.New("no revocation endpoint"))
+	}
+
+	v := url.Values{"token": {token}}
+	if hint != "" {
+		v.Set("token_type_hint", hint)
+	}
+	req, err := c.newAuthenticatedRequest(c.revocationURL, v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return newError(ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return newError(ErrProviderUnavailable, err)
+	}
+	// The authorization server responds with 200 OK also if the token was invalid (RFC 7009 2.2).
+	if resp.StatusCode != http.StatusOK {
+		return parseErrorResponse(resp, body)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+)
+
+func TestOAuth2ClientRevokeToken(t *testing.T) {
+	d := &testDoer{Response: newTestResponse(200, "", "")}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretBasic)
+	c.revocationURL = "http://example.com/revoke"
+
+	if err := c.RevokeToken(context.Background(), "test-token", TokenTypeHintRefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Request.Method != "POST" || d.Request.URL.String() != "http://example.com/revoke" {
+		t.Errorf("Wrong request %v %v", d.Request.Method, d.Request.URL)
+	}
+	if id, secret, ok := d.Request.BasicAuth(); !ok || id != "test-id" || secret != "test-secret" {
+		t.Error("Wrong client authentication sent")
+	}
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("token") != "test-token" || d.Request.PostForm.Get("token_type_hint") != "refresh_token" {
+		t.Errorf("Wrong form sent %v", d.Request.PostForm)
+	}
+}
+
+func TestOAuth2ClientRevokeTokenClientSecretPost(t *testing.T) {
+	d := &testDoer{Response: newTestResponse(200, "", "")}
+	c := newTestOAuth2Client(d, oauth2.AuthMethodClientSecretPost)
+	c.revocationURL = "http://example.com/revoke"
+
+	if err := c.RevokeToken(context.Background(), "test-token", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Request.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Request.PostForm.Get("client_id") != "test-id" || d.Request.PostForm.Get("client_secret") != "test-secret" {
+		t.Error("Wrong client authentication sent")
+	}
+	if _, ok := d.Request.PostForm["token_type_hint"]; ok {
+		t.Error("Empty hint sent")
+	}
+}
+
+func TestOAuth2ClientRevokeTokenErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		url  string
+		d    *testDoer
+		err  error
+	}{
+		{"unsupported", "", &testDoer{}, ErrUnsupported},
+		{"network error", "http://example.com/revoke", &testDoer{Error: errors.New("test")}, ErrProviderUnavailable},
+		{"server error", "http://example.com/revoke", &testDoer{Response: newTestResponse(503, "application/json", `{"error":"unsupported_token_type"}`)}, ErrAuthorization},
+		{"unavailable", "http://example.com/revoke", &testDoer{Response: newTestResponse(503, "text/plain", "unavailable")}, ErrProviderUnavailable},
+		{"invalid client", "http://example.com/revoke", &testDoer{Response: newTestResponse(401, "application/json", `{"error":"invalid_client"}`)}, ErrAuthorization},
+	}
+	for _, c := range cases {
+		oac := newTestOAuth2Client(c.d, oauth2.AuthMethodClientSecretBasic)
+		oac.revocationURL = c.url
+
+		if err := oac.RevokeToken(context.Background(), "test-token", ""); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestClientRevokeToken(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	var revoked int32
+	p.Mux.HandleFunc("/oidc/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("token") == "test-token" {
+			atomic.StoreInt32(&revoked, 1)
+		}
+	})
+	p.Mux.HandleFunc("/oidc/introspect", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.LoadInt32(&revoked) != 0 {
+			w.Write([]byte(`{"active":false}`))
+			return
+		}
+		w.Write([]byte(`{"active":true}`))
+	})
+	cfg := newTestConfig(p)
+	cfg.IntrospectionCacheTTL = time.Hour
+
+	mc, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	if i, err := mc.Introspect("test-token"); err != nil || !i.Active {
+		t.Fatalf("Token not active: %v", err)
+	}
+	if err = mc.RevokeToken("test-token", TokenTypeHintAccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if revoked == 0 {
+		t.Error("Token not revoked")
+	}
+	// The cached introspection result is dropped.
+	if i, err := mc.Introspect("test-token"); err != nil || i.Active {
+		t.Errorf("Revoked token active: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package maas
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// SessionCookieName is the name of the cookie holding the session ID.
+	SessionCookieName = "maas_session"
+	// SessionTTL is the time for which a session is valid.
+	SessionTTL = 24 * time.Hour
+
+	sessionIDLength = 32
+)
+
+// ErrNoSession is returned when the request has no valid session.
+var ErrNoSession = errors.New("no session")
+
+// Session holds the authorization data of a logged in user.
+type Session struct {
+	UserInfo UserInfo
+	Token    Token
+}
+
+// SessionStore keeps the sessions of the logged in users.
+type SessionStore interface {
+	// Get returns the session of the browser making request `r` or ErrNoSession if there is none.
+	Get(r *http.Request) (Session, error)
+	// Save creates or replaces the session of the browser making request `r`.
+	Save(w http.ResponseWriter, r *http.Request, s Session) error
+	// Delete removes the session of the browser making request `r`.
+	Delete(w http.ResponseWriter, r *http.Request) error
+}
+
+type memorySessionEntry struct {
+	session Session
+	expires time.Time
+}
+
+// MemorySessionStore is a `SessionStore` keeping the sessions in memory,
+// identified by a random session ID stored in a cookie.
+// It is suitable for single instance deployments only.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]memorySessionEntry
+	clock    clockwork.Clock
+}
+
+// NewMemorySessionStore creates a new `MemorySessionStore`.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]memorySessionEntry{},
+		clock:    clockwork.NewRealClock(),
+	}
+}
+
+// Get returns the session of the browser making request `r`.
+func (s *MemorySessionStore) Get(r *http.Request) (Session, error) {
+	c, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return Session{}, ErrNoSession
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.sessions[c.Value]
+	if !ok || e.expires.Before(s.clock.Now()) {
+		return Session{}, ErrNoSession
+	}
+
+	return e.session, nil
+}
+
+// Save creates a new session for the browser making request `r`.
+// Any previous session of the browser is removed.
+func (s *MemorySessionStore) Save(w http.ResponseWriter, r *http.Request, session Session) error {
+	id, err := randomString(sessionIDLength)
+	if err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	expires := now.Add(SessionTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, err := r.Cookie(SessionCookieName); err == nil {
+		delete(s.sessions, c.Value)
+	}
+	for k, e := range s.sessions {
+		if e.expires.Before(now) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = memorySessionEntry{session: session, expires: expires}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Delete removes the session of the browser making request `r`.
+func (s *MemorySessionStore) Delete(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	delete(s.sessions, c.Value)
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// DeleteMatching removes all the sessions for which `match` returns true,
+// e.g. `LogoutToken.Matches` for the sessions ended by the authorization server.
+func (s *MemorySessionStore) DeleteMatching(match func(Session) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, e := range s.sessions {
+		if match(e.session) {
+			delete(s.sessions, k)
+		}
+	}
+}
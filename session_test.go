@@ -0,0 +1,88 @@
+package maas
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// withCookies creates a request carrying the cookies set in `rec`.
+func withCookies(rec *httptest.ResponseRecorder, method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s := NewMemorySessionStore()
+	s.clock = clock
+
+	session := Session{UserInfo: UserInfo{UserID: "test", Email: "test@example.net"}, Token: Token{AccessToken: "test-ac"}}
+
+	rec := httptest.NewRecorder()
+	if err := s.Save(rec, httptest.NewRequest("GET", "/", nil), session); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(withCookies(rec, "GET", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserInfo != session.UserInfo || got.Token.AccessToken != session.Token.AccessToken {
+		t.Errorf("Wrong session returned %+v", got)
+	}
+
+	if _, err := s.Get(httptest.NewRequest("GET", "/", nil)); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession for request without cookie, got %v", err)
+	}
+
+	clock.Advance(SessionTTL + time.Second)
+	if _, err := s.Get(withCookies(rec, "GET", "/")); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession for expired session, got %v", err)
+	}
+}
+
+func TestMemorySessionStoreDelete(t *testing.T) {
+	s := NewMemorySessionStore()
+
+	rec := httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), Session{})
+
+	r := withCookies(rec, "GET", "/")
+	if err := s.Delete(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(r); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession after delete, got %v", err)
+	}
+}
+
+func TestMemorySessionStoreDeleteMatching(t *testing.T) {
+	s := NewMemorySessionStore()
+	recs := map[string]*httptest.ResponseRecorder{}
+	for _, sub := range []string{"a", "b"} {
+		recs[sub] = httptest.NewRecorder()
+		if err := s.Save(recs[sub], httptest.NewRequest("GET", "/", nil), Session{UserInfo: UserInfo{UserID: sub}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.DeleteMatching(func(session Session) bool {
+		return session.UserInfo.UserID == "a"
+	})
+
+	if _, err := s.Get(withCookies(recs["a"], "GET", "/")); err != ErrNoSession {
+		t.Error("Matching session not deleted")
+	}
+	if _, err := s.Get(withCookies(recs["b"], "GET", "/")); err != nil {
+		t.Errorf("Other session deleted: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package maas
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// StateCookieName is the name of the cookie used by the state stores to bind the state to the browser.
+	StateCookieName = "maas_state"
+	// StateTTL is the time for which a saved state is valid.
+	StateTTL = 10 * time.Minute
+	// MaxMemoryStates is the maximum number of states kept by a `MemoryStateStore`.
+	MaxMemoryStates = 100000
+	// MinStateSecretLength is the minimum length in bytes of the secret of a `CookieStateStore`.
+	MinStateSecretLength = 32
+
+	stateLength = 32
+)
+
+// ErrInvalidState is returned when the state of the callback request
+// doesn't match any state saved for the browser.
+var ErrInvalidState = errors.New("invalid state")
+
+// ErrStateStoreFull is returned when a `MemoryStateStore` already holds `MaxMemoryStates` valid states.
+var ErrStateStoreFull = errors.New("state store full")
+
+// StateStore binds the state of an authorization request (along with its `AuthParams`)
+// to the browser between the authorization request and the callback.
+type StateStore interface {
+	// Save stores `state` and `p` for the browser making request `r`.
+	Save(w http.ResponseWriter, r *http.Request, state string, p AuthParams) error
+	// Load retrieves and removes the `AuthParams` saved for `state` by the browser making request `r`.
+	// It returns ErrInvalidState if no such state is saved or it has expired.
+	Load(w http.ResponseWriter, r *http.Request, state string) (AuthParams, error)
+}
+
+// NewState generates a new random state value for an authorization request.
+func NewState() (string, error) {
+	return randomString(stateLength)
+}
+
+// NewAuthRequestURL generates random state, nonce and PKCE code verifier,
+// saves them in `store` and returns the authorization request URL
+// the browser making request `r` should be redirected to.
+func NewAuthRequestURL(mc Client, store StateStore, w http.ResponseWriter, r *http.Request) (string, error) {
+	state, err := NewState()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := NewNonce()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := NewCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	p := AuthParams{
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+	}
+	if err = store.Save(w, r, state, p); err != nil {
+		return "", err
+	}
+
+	return mc.GetAuthRequestURLWithParamsContext(r.Context(), state, p)
+}
+
+// ValidateCallback verifies the state of callback request `r` against the one saved in `store`
+// and exchanges the authorization code from it for a `Token`.
+// Returns ErrInvalidState if the state is not valid for the browser
+// and `*Error` wrapping *oauth2.Error if the authorization server responded with an error.
+func ValidateCallback(mc Client, store StateStore, w http.ResponseWriter, r *http.Request) (Token, error) {
+	q := r.URL.Query()
+
+	p, err := store.Load(w, r, q.Get("state"))
+	if err != nil {
+		return Token{}, err
+	}
+
+	if e := q.Get("error"); e != "" {
+		return Token{}, newOAuthError(&oauth2.Error{Type: e, Description: q.Get("error_description"), State: q.Get("state")})
+	}
+
+	return mc.ValidateAuthTokenContext(r.Context(), q.Get("code"), p)
+}
+
+func setStateCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearStateCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// stateEquals compares states in constant time.
+func stateEquals(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
+
+type memoryStateEntry struct {
+	params  AuthParams
+	expires time.Time
+}
+
+// MemoryStateStore is a `StateStore` keeping the `AuthParams` in memory
+// and binding the state to the browser with a cookie.
+// It is suitable for single instance deployments only.
+// At most `MaxMemoryStates` states are kept, as anyone can start an authorization request.
+type MemoryStateStore struct {
+	mu         sync.Mutex
+	entries    map[string]memoryStateEntry
+	swept      time.Time // Time the expired entries were last removed.
+	maxEntries int
+	clock      clockwork.Clock
+}
+
+// NewMemoryStateStore creates a new `MemoryStateStore`.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		entries:    map[string]memoryStateEntry{},
+		maxEntries: MaxMemoryStates,
+		clock:      clockwork.NewRealClock(),
+	}
+}
+
+// Save stores `state` and `p` for the browser making request `r`.
+// The expired states are removed at most once per `StateTTL`.
+// Returns ErrStateStoreFull if `MaxMemoryStates` states are already stored.
+func (s *MemoryStateStore) Save(w http.ResponseWriter, r *http.Request, state string, p AuthParams) error {
+	now := s.clock.Now()
+	expires := now.Add(StateTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= StateTTL {
+		for k, e := range s.entries {
+			if e.expires.Before(now) {
+				delete(s.entries, k)
+			}
+		}
+		s.swept = now
+	}
+	if len(s.entries) >= s.maxEntries {
+		return ErrStateStoreFull
+	}
+	s.entries[state] = memoryStateEntry{params: p, expires: expires}
+
+	setStateCookie(w, r, state, expires)
+	return nil
+}
+
+// Load retrieves and removes the `AuthParams` saved for `state` by the browser making request `r`.
+func (s *MemoryStateStore) Load(w http.ResponseWriter, r *http.Request, state string) (AuthParams, error) {
+	c, err := r.Cookie(StateCookieName)
+	if err != nil || state == "" || !stateEquals(c.Value, state) {
+		return AuthParams{}, ErrInvalidState
+	}
+	clearStateCookie(w, r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[state]
+	if !ok {
+		return AuthParams{}, ErrInvalidState
+	}
+	delete(s.entries, state)
+	if e.expires.Before(s.clock.Now()) {
+		return AuthParams{}, ErrInvalidState
+	}
+
+	return e.params, nil
+}
+
+type cookieState struct {
+	State        string `json:"s"`
+	CodeVerifier string `json:"v,omitempty"`
+	Nonce        string `json:"n,omitempty"`
+	Expires      int64  `json:"e"`
+}
+
+// CookieStateStore is a `StateStore` keeping the state and the `AuthParams`
+// in a cookie signed with HMAC-SHA256. It doesn't need any server side storage.
+// Note that the cookie is not encrypted, so the PKCE code verifier and the nonce
+// are visible to the browser.
+type CookieStateStore struct {
+	secret []byte
+	clock  clockwork.Clock
+}
+
+// NewCookieStateStore creates a new `CookieStateStore`.
+// Argument `secret` is the key used to sign the cookie. It must be at least `MinStateSecretLength` random bytes,
+// otherwise the cookie could be forged.
+func NewCookieStateStore(secret []byte) (*CookieStateStore, error) {
+	if len(secret) < MinStateSecretLength {
+		return nil, fmt.Errorf("state secret too short: %v bytes, at least %v required", len(secret), MinStateSecretLength)
+	}
+	return &CookieStateStore{
+		secret: secret,
+		clock:  clockwork.NewRealClock(),
+	}, nil
+}
+
+// Save stores `state` and `p` for the browser making request `r`.
+func (s *CookieStateStore) Save(w http.ResponseWriter, r *http.Request, state string, p AuthParams) error {
+	expires := s.clock.Now().Add(StateTTL)
+
+	payload, err := json.Marshal(cookieState{
+		State:        state,
+		CodeVerifier: p.CodeVerifier,
+		Nonce:        p.Nonce,
+		Expires:      expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	setStateCookie(w, r, value+"."+s.sign(value), expires)
+	return nil
+}
+
+// Load retrieves and removes the `AuthParams` saved for `state` by the browser making request `r`.
+func (s *CookieStateStore) Load(w http.ResponseWriter, r *http.Request, state string) (AuthParams, error) {
+	c, err := r.Cookie(StateCookieName)
+	if err != nil || state == "" {
+		return AuthParams{}, ErrInvalidState
+	}
+	clearStateCookie(w, r)
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return AuthParams{}, ErrInvalidState
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return AuthParams{}, ErrInvalidState
+	}
+	var cs cookieState
+	if err = json.Unmarshal(payload, &cs); err != nil {
+		return AuthParams{}, ErrInvalidState
+	}
+
+	if !stateEquals(cs.State, state) || time.Unix(cs.Expires, 0).Before(s.clock.Now()) {
+		return AuthParams{}, ErrInvalidState
+	}
+
+	return AuthParams{CodeVerifier: cs.CodeVerifier, Nonce: cs.Nonce}, nil
+}
+
+func (s *CookieStateStore) sign(value string) string {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,234 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+// callbackRequest creates a callback request carrying the cookies set in `rec`.
+func callbackRequest(rec *httptest.ResponseRecorder, query string) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/oidc?"+query, nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func testStateStore(t *testing.T, s StateStore, clock clockwork.FakeClock) {
+	p := AuthParams{CodeVerifier: "test-verifier", Nonce: "test-nonce"}
+
+	// Round trip
+	rec := httptest.NewRecorder()
+	if err := s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", p); err != nil {
+		t.Fatal(err)
+	}
+	r := callbackRequest(rec, "state=test-state")
+	loaded, err := s.Load(httptest.NewRecorder(), r, "test-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != p {
+		t.Errorf("Wrong params loaded %+v", loaded)
+	}
+
+	// Different state
+	rec = httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", p)
+	if _, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), "other-state"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState for different state, got %v", err)
+	}
+
+	// Different browser
+	if _, err := s.Load(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "test-state"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState for request without cookie, got %v", err)
+	}
+
+	// Expired
+	rec = httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", p)
+	clock.Advance(StateTTL + time.Second)
+	if _, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), "test-state"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState for expired state, got %v", err)
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s := NewMemoryStateStore()
+	s.clock = clock
+
+	testStateStore(t, s, clock)
+}
+
+func TestMemoryStateStoreReplay(t *testing.T) {
+	s := NewMemoryStateStore()
+
+	rec := httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", AuthParams{})
+	if _, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), "test-state"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), "test-state"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState on replay, got %v", err)
+	}
+}
+
+func TestMemoryStateStoreFull(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s := NewMemoryStateStore()
+	s.clock = clock
+	s.maxEntries = 2
+
+	for i, state := range []string{"state-1", "state-2"} {
+		if err := s.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), state, AuthParams{}); err != nil {
+			t.Fatalf("Save %v: %v", i, err)
+		}
+	}
+	if err := s.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "state-3", AuthParams{}); err != ErrStateStoreFull {
+		t.Errorf("Expected ErrStateStoreFull, got %v", err)
+	}
+
+	// The expired states are removed once per StateTTL.
+	clock.Advance(StateTTL + time.Second)
+	if err := s.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "state-3", AuthParams{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.entries) != 1 {
+		t.Errorf("Expired states not removed, %v left", len(s.entries))
+	}
+}
+
+// newTestCookieStateStore returns a `CookieStateStore` with `secret` padded to the minimum length.
+func newTestCookieStateStore(t *testing.T, secret string) *CookieStateStore {
+	s, err := NewCookieStateStore([]byte(secret + strings.Repeat("0", MinStateSecretLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCookieStateStore(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	s := newTestCookieStateStore(t, "test-secret")
+	s.clock = clock
+
+	testStateStore(t, s, clock)
+}
+
+func TestCookieStateStoreShortSecret(t *testing.T) {
+	for _, secret := range [][]byte{nil, []byte("test-secret"), make([]byte, MinStateSecretLength-1)} {
+		if _, err := NewCookieStateStore(secret); err == nil {
+			t.Errorf("Secret of %v bytes accepted", len(secret))
+		}
+	}
+}
+
+func TestCookieStateStoreTampered(t *testing.T) {
+	s := newTestCookieStateStore(t, "test-secret")
+	other := newTestCookieStateStore(t, "other-secret")
+
+	rec := httptest.NewRecorder()
+	other.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", AuthParams{})
+	if _, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), "test-state"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState for cookie with wrong signature, got %v", err)
+	}
+}
+
+func TestNewAuthRequestURL(t *testing.T) {
+	mc := &testClient{URL: "test-url"}
+	s := NewMemoryStateStore()
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), testContextKey{}, "test"))
+	u, err := NewAuthRequestURL(mc, s, rec, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Ctx == nil || mc.Ctx.Value(testContextKey{}) != "test" {
+		t.Error("Request context not used")
+	}
+
+	if u != mc.URL {
+		t.Error("Different URL returned")
+	}
+	if mc.State == "" || mc.Params.Nonce == "" || mc.Params.CodeVerifier == "" {
+		t.Errorf("State, nonce or code verifier not generated: %v %+v", mc.State, mc.Params)
+	}
+
+	p, err := s.Load(httptest.NewRecorder(), callbackRequest(rec, ""), mc.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != mc.Params {
+		t.Error("Wrong params saved")
+	}
+}
+
+func TestValidateCallback(t *testing.T) {
+	mc := &testClient{Token: Token{AccessToken: "test-ac"}}
+	s := NewMemoryStateStore()
+	p := AuthParams{CodeVerifier: "test-verifier", Nonce: "test-nonce"}
+
+	rec := httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", p)
+
+	r := callbackRequest(rec, "code=test-code&state=test-state")
+	tkn, err := ValidateCallback(mc, s, httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Ctx != r.Context() {
+		t.Error("Request context not passed")
+	}
+	if tkn.AccessToken != "test-ac" {
+		t.Error("Wrong access token returned")
+	}
+	if mc.Code != "test-code" {
+		t.Error("Wrong code passed")
+	}
+	if mc.Params != p {
+		t.Error("Wrong params passed")
+	}
+}
+
+func TestValidateCallbackInvalidState(t *testing.T) {
+	mc := &testClient{}
+	s := NewMemoryStateStore()
+
+	rec := httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", AuthParams{})
+
+	_, err := ValidateCallback(mc, s, httptest.NewRecorder(), callbackRequest(rec, "code=test-code&state=other-state"))
+	if err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState, got %v", err)
+	}
+	if mc.Code != "" {
+		t.Error("Code exchanged with invalid state")
+	}
+}
+
+func TestValidateCallbackError(t *testing.T) {
+	mc := &testClient{}
+	s := NewMemoryStateStore()
+
+	rec := httptest.NewRecorder()
+	s.Save(rec, httptest.NewRequest("GET", "/", nil), "test-state", AuthParams{})
+
+	_, err := ValidateCallback(mc, s, httptest.NewRecorder(), callbackRequest(rec, "error=access_denied&state=test-state"))
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied, got %v", err)
+	}
+	var oerr *oauth2.Error
+	if !errors.As(err, &oerr) || oerr.Type != oauth2.ErrorAccessDenied {
+		t.Errorf("Expected access_denied error, got %#v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+// Token holds the tokens issued by the authorization server.
+type Token struct {
+	AccessToken  string      // Access token to be used for requests to the resource servers, e.g. `GetUserInfo`.
+	TokenType    string      // Type of the access token, normally "Bearer".
+	RefreshToken string      // Refresh token to be used with `RefreshTokens`. Empty if the authorization server didn't issue one.
+	IDToken      jose.JWT    // Verified ID token.
+	Claims       jose.Claims // Claims of the ID token. Nil if no ID token was issued.
+	Expiry       time.Time   // Expiry of the access token, computed with `Config.Clock`. Zero if the authorization server didn't specify it.
+	Scope        []string    // Granted scopes. Empty if the authorization server didn't return them, which means they are the same as requested.
+	RawBody      []byte      // Raw token response, in case other non-standard values are needed.
+}
+
+// Subject returns the `sub` claim of the ID token, identifying the user.
+func (t Token) Subject() string {
+	sub, _, _ := t.Claims.StringClaim("sub")
+	return sub
+}
+
+// SessionID returns the `sid` claim of the ID token, identifying the session of the user at the authorization server.
+// Empty if the authorization server doesn't support it.
+func (t Token) SessionID() string {
+	sid, _, _ := t.Claims.StringClaim("sid")
+	return sid
+}
+
+// Expired reports whether the access token is expired at time `now`.
+// Tokens without expiry never expire.
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expiry.IsZero() && !now.Before(t.Expiry)
+}
+
+// RefreshTokens exchanges the refresh token of `t` for a fresh `Token`.
+// The ID token, if returned by the authorization server, is verified the same way as by `ValidateAuthToken`
+// and must be issued by the same issuer for the same user as the ID token of `t` (OIDC Core 12.2).
+// Otherwise the ID token of `t` is kept.
+// Argument `t` is a `Token` issued earlier.
+// Returns an error matching ErrInvalidGrant with errors.Is if `t` has no refresh token.
+func (mc *client) RefreshTokens(t Token) (Token, error) {
+	return mc.RefreshTokensContext(context.Background(), t)
+}
+
+// RefreshTokensContext exchanges the refresh token of `t` for a fresh `Token` like `RefreshTokens`.
+// Argument `ctx` is used for the token request.
+func (mc *client) RefreshTokensContext(ctx context.Context, t Token) (Token, error) {
+	s, err := mc.getState(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	return refreshTokens(ctx, t, s.oidc, s.oauth, mc.config.Clock)
+}
+
+func refreshTokens(ctx context.Context, t Token, oidc oidcClient, oac oauthClient, clock clockwork.Clock) (Token, error) {
+	if t.RefreshToken == "" {
+		return Token{}, newError(ErrInvalidGrant, errors.New("no refresh token"))
+	}
+	tr, err := oac.RequestToken(ctx, oauth2.GrantTypeRefreshToken, t.RefreshToken, nil)
+	if err != nil {
+		return Token{}, err
+	}
+
+	// The authorization server may keep the refresh token unchanged.
+	if tr.RefreshToken == "" {
+		tr.RefreshToken = t.RefreshToken
+	}
+	// The ID token is optional in the refresh response.
+	if tr.IDToken == "" {
+		refreshed := tokenFromResponse(tr, clock)
+		refreshed.IDToken = t.IDToken
+		refreshed.Claims = t.Claims
+		return refreshed, nil
+	}
+
+	refreshed, err := newToken(ctx, tr, oidc, clock)
+	if err != nil {
+		return Token{}, err
+	}
+	if err = verifyRefreshedIDToken(t, refreshed); err != nil {
+		return Token{}, err
+	}
+	return refreshed, nil
+}
+
+// verifyRefreshedIDToken checks that the ID token of `refreshed` has the same `iss` and `sub` claims
+// as the ID token of `t` it was refreshed from (OIDC Core 12.2). Nothing is checked if `t` has no ID token.
+func verifyRefreshedIDToken(t, refreshed Token) error {
+	if t.Claims == nil {
+		return nil
+	}
+	expected, _, _ := t.Claims.StringClaim("iss")
+	if iss, _, _ := refreshed.Claims.StringClaim("iss"); iss != expected {
+		return newError(ErrInvalidIssuer, fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", expected, iss))
+	}
+	if sub := refreshed.Subject(); sub != t.Subject() {
+		return newError(ErrInvalidToken, fmt.Errorf("invalid claim value: 'sub'. expected=%s, found=%s", t.Subject(), sub))
+	}
+	return nil
+}
+
+// newToken verifies the ID token from token response `tr` and constructs a `Token` from it.
+// Argument `ctx` is used for fetching the keys of the authorization server.
+func newToken(ctx context.Context, tr oauth2.TokenResponse, oidc oidcClient, clock clockwork.Clock) (Token, error) {
+	jwt, err := jose.ParseJWT(tr.IDToken)
+	if err != nil {
+		return Token{}, newError(ErrMalformedToken, err)
+	}
+	if err = oidc.VerifyJWT(ctx, jwt); err != nil {
+		return Token{}, err
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return Token{}, newError(ErrMalformedToken, err)
+	}
+
+	t := tokenFromResponse(tr, clock)
+	t.IDToken = jwt
+	t.Claims = claims
+	return t, nil
+}
+
+// tokenFromResponse constructs a `Token` without ID token from token response `tr`.
+func tokenFromResponse(tr oauth2.TokenResponse, clock clockwork.Clock) Token {
+	return Token{
+		AccessToken:  tr.AccessToken,
+		TokenType:    tr.TokenType,
+		RefreshToken: tr.RefreshToken,
+		Expiry:       expiry(tr.Expires, clock),
+		Scope:        strings.Fields(tr.Scope),
+		RawBody:      tr.RawBody,
+	}
+}
+
+// expiry converts `expires_in` seconds to absolute time.
+func expiry(expiresIn int, clock clockwork.Clock) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return clock.Now().Add(time.Duration(expiresIn) * time.Second)
+}
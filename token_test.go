@@ -0,0 +1,194 @@
+package maas
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestValidateAuthToken(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	jwt := newTestJWT(t, jose.Claims{"sub": "test", "email": "test@example.net"})
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken:  "test-ac",
+			TokenType:    "Bearer",
+			RefreshToken: "test-rt",
+			IDToken:      jwt.Encode(),
+			Expires:      3600,
+			Scope:        "openid email",
+			RawBody:      []byte("test-body"),
+		},
+	}
+
+	tkn, err := validateAuth(context.Background(), "test-code", AuthParams{}, &testOIDC{}, oac, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tkn.TokenType != "Bearer" {
+		t.Error("Wrong token type")
+	}
+	if tkn.RefreshToken != "test-rt" {
+		t.Error("Wrong refresh token")
+	}
+	if !tkn.Expiry.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("Wrong expiry %v", tkn.Expiry)
+	}
+	if len(tkn.Scope) != 2 || tkn.Scope[0] != "openid" || tkn.Scope[1] != "email" {
+		t.Errorf("Wrong scope %v", tkn.Scope)
+	}
+	if tkn.Subject() != "test" || tkn.Claims["email"] != "test@example.net" {
+		t.Errorf("Wrong claims %v", tkn.Claims)
+	}
+	if string(tkn.RawBody) != "test-body" {
+		t.Error("Wrong raw body")
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	now := time.Now()
+
+	if (Token{}).Expired(now) {
+		t.Error("Token without expiry expired")
+	}
+	if (Token{Expiry: now.Add(time.Second)}).Expired(now) {
+		t.Error("Valid token expired")
+	}
+	if !(Token{Expiry: now}).Expired(now) {
+		t.Error("Expired token not expired")
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	jwt := newTestJWT(t, jose.Claims{"sub": "test"})
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken:  "new-ac",
+			RefreshToken: "new-rt",
+			IDToken:      jwt.Encode(),
+			Expires:      60,
+		},
+	}
+	oidc := &testOIDC{}
+
+	tkn, err := refreshTokens(context.Background(), Token{RefreshToken: "test-rt"}, oidc, oac, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if oac.GrantType != oauth2.GrantTypeRefreshToken {
+		t.Error("Wrong grant type")
+	}
+	if oac.Value != "test-rt" {
+		t.Error("Wrong refresh token sent")
+	}
+	if oidc.IDToken.Encode() != jwt.Encode() {
+		t.Error("ID token not verified")
+	}
+	if tkn.AccessToken != "new-ac" || tkn.RefreshToken != "new-rt" {
+		t.Errorf("Wrong tokens returned %+v", tkn)
+	}
+	if !tkn.Expiry.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("Wrong expiry %v", tkn.Expiry)
+	}
+}
+
+func TestRefreshTokensWithoutRefreshToken(t *testing.T) {
+	oac := &testOAC{}
+	_, err := refreshTokens(context.Background(), Token{AccessToken: "test-ac"}, &testOIDC{}, oac, clockwork.NewFakeClock())
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("Expected ErrInvalidGrant, got %v", err)
+	}
+	if oac.GrantType != "" {
+		t.Error("Token requested without refresh token")
+	}
+}
+
+func TestRefreshTokensWithoutIDToken(t *testing.T) {
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken: "new-ac",
+		},
+	}
+	oidc := &testOIDC{}
+
+	idToken := newTestJWT(t, jose.Claims{"sub": "test"})
+	prev := Token{RefreshToken: "test-rt", IDToken: idToken, Claims: jose.Claims{"sub": "test"}}
+
+	tkn, err := refreshTokens(context.Background(), prev, oidc, oac, clockwork.NewFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tkn.AccessToken != "new-ac" {
+		t.Error("Wrong access token")
+	}
+	if tkn.RefreshToken != "test-rt" {
+		t.Error("Refresh token not kept")
+	}
+	if !tkn.Expiry.IsZero() {
+		t.Error("Unexpected expiry")
+	}
+	if tkn.IDToken.Encode() != idToken.Encode() || tkn.Subject() != "test" {
+		t.Error("ID token not kept")
+	}
+}
+
+func TestRefreshTokensInvalidIDToken(t *testing.T) {
+	jwt := newTestJWT(t, jose.Claims{"sub": "test"})
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken: "new-ac",
+			IDToken:     jwt.Encode(),
+		},
+	}
+	oidc := &testOIDC{Err: errors.New("test error")}
+
+	if _, err := refreshTokens(context.Background(), Token{RefreshToken: "test-rt"}, oidc, oac, clockwork.NewFakeClock()); !errors.Is(err, oidc.Err) {
+		t.Errorf("Expected verification error, got %v", err)
+	}
+}
+
+func TestRefreshTokensIDTokenMismatch(t *testing.T) {
+	prev := Token{RefreshToken: "test-rt", Claims: jose.Claims{"iss": "https://example.com", "sub": "test"}}
+	cases := []struct {
+		name   string
+		claims jose.Claims
+		err    error
+	}{
+		{"other issuer", jose.Claims{"iss": "https://other.example.com", "sub": "test"}, ErrInvalidIssuer},
+		{"other subject", jose.Claims{"iss": "https://example.com", "sub": "other"}, ErrInvalidToken},
+		{"no subject", jose.Claims{"iss": "https://example.com"}, ErrInvalidToken},
+	}
+	for _, c := range cases {
+		jwt := newTestJWT(t, c.claims)
+		oac := &testOAC{
+			Result: oauth2.TokenResponse{
+				AccessToken: "new-ac",
+				IDToken:     jwt.Encode(),
+			},
+		}
+
+		if _, err := refreshTokens(context.Background(), prev, &testOIDC{}, oac, clockwork.NewFakeClock()); !errors.Is(err, c.err) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	jwt := newTestJWT(t, jose.Claims{"iss": "https://example.com", "sub": "test"})
+	oac := &testOAC{
+		Result: oauth2.TokenResponse{
+			AccessToken: "new-ac",
+			IDToken:     jwt.Encode(),
+		},
+	}
+	if _, err := refreshTokens(context.Background(), prev, &testOIDC{}, oac, clockwork.NewFakeClock()); err != nil {
+		t.Errorf("Matching ID token rejected: %v", err)
+	}
+}
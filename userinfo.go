@@ -0,0 +1,336 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+)
+
+// MaxUserInfoSize is the maximum size of the UserInfo response body in bytes.
+const MaxUserInfoSize = 1 << 20
+
+// Bearer token error codes returned by the UserInfo endpoint in the `WWW-Authenticate` header (RFC 6750).
+const (
+	BearerErrorInvalidRequest    = "invalid_request"
+	BearerErrorInvalidToken      = "invalid_token"
+	BearerErrorInsufficientScope = "insufficient_scope"
+)
+
+// UserInfo holds user information retrieved from UserInfo endpoint.
+// The fields hold the standard claims (OIDC Core 5.1); all the claims,
+// including the non-standard ones, are returned as `UserInfoClaims` by `GetUserInfoClaims`.
+type UserInfo struct {
+	UserID              string    `json:"sub"`
+	Name                string    `json:"name,omitempty"`
+	GivenName           string    `json:"given_name,omitempty"`
+	FamilyName          string    `json:"family_name,omitempty"`
+	MiddleName          string    `json:"middle_name,omitempty"`
+	Nickname            string    `json:"nickname,omitempty"`
+	PreferredUsername   string    `json:"preferred_username,omitempty"`
+	Profile             string    `json:"profile,omitempty"`
+	Picture             string    `json:"picture,omitempty"`
+	Website             string    `json:"website,omitempty"`
+	Email               string    `json:"email"`
+	EmailVerified       bool      `json:"email_verified,omitempty"`
+	Gender              string    `json:"gender,omitempty"`
+	Birthdate           string    `json:"birthdate,omitempty"`
+	Zoneinfo            string    `json:"zoneinfo,omitempty"`
+	Locale              string    `json:"locale,omitempty"`
+	PhoneNumber         string    `json:"phone_number,omitempty"`
+	PhoneNumberVerified bool      `json:"phone_number_verified,omitempty"`
+	Address             *Address  `json:"address,omitempty"`
+	UpdatedAt           time.Time `json:"-"` // Time of the last update of the information (`updated_at`).
+}
+
+// Address holds the postal address of the user (`address` claim).
+type Address struct {
+	Formatted     string `json:"formatted,omitempty"`
+	StreetAddress string `json:"street_address,omitempty"`
+	Locality      string `json:"locality,omitempty"`
+	Region        string `json:"region,omitempty"`
+	PostalCode    string `json:"postal_code,omitempty"`
+	Country       string `json:"country,omitempty"`
+}
+
+type userInfo UserInfo
+
+type userInfoJSON struct {
+	*userInfo
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+}
+
+// UnmarshalJSON decodes the standard claims into the fields.
+func (ui *UserInfo) UnmarshalJSON(data []byte) error {
+	var claims jose.Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	u := userInfoJSON{userInfo: &userInfo{}}
+	if err := json.Unmarshal(data, &u); err != nil {
+		return err
+	}
+	updatedAt, _, err := claims.TimeClaim("updated_at")
+	if err != nil {
+		return err
+	}
+
+	*ui = UserInfo(*u.userInfo)
+	ui.UpdatedAt = updatedAt
+	return nil
+}
+
+// MarshalJSON encodes the standard claims.
+func (ui UserInfo) MarshalJSON() ([]byte, error) {
+	u := userInfoJSON{userInfo: (*userInfo)(&ui)}
+	if !ui.UpdatedAt.IsZero() {
+		u.UpdatedAt = ui.UpdatedAt.Unix()
+	}
+	return json.Marshal(u)
+}
+
+// UserInfoClaims holds all the claims of the UserInfo response, including the non-standard ones.
+type UserInfoClaims jose.Claims
+
+// StringClaim returns the value of string claim `name` and whether the claim is present.
+func (c UserInfoClaims) StringClaim(name string) (string, bool, error) {
+	return jose.Claims(c).StringClaim(name)
+}
+
+// StringsClaim returns the value of string array claim `name` and whether the claim is present.
+func (c UserInfoClaims) StringsClaim(name string) ([]string, bool, error) {
+	return jose.Claims(c).StringsClaim(name)
+}
+
+// Int64Claim returns the value of integer claim `name` and whether the claim is present.
+func (c UserInfoClaims) Int64Claim(name string) (int64, bool, error) {
+	return jose.Claims(c).Int64Claim(name)
+}
+
+// Float64Claim returns the value of number claim `name` and whether the claim is present.
+func (c UserInfoClaims) Float64Claim(name string) (float64, bool, error) {
+	return jose.Claims(c).Float64Claim(name)
+}
+
+// TimeClaim returns the value of time claim `name` (seconds since the epoch) and whether the claim is present.
+func (c UserInfoClaims) TimeClaim(name string) (time.Time, bool, error) {
+	return jose.Claims(c).TimeClaim(name)
+}
+
+// BoolClaim returns the value of boolean claim `name` and whether the claim is present.
+func (c UserInfoClaims) BoolClaim(name string) (bool, bool, error) {
+	cl, ok := c[name]
+	if !ok {
+		return false, false, nil
+	}
+	v, ok := cl.(bool)
+	if !ok {
+		return false, false, fmt.Errorf("unable to parse claim as bool: %v", name)
+	}
+	return v, true, nil
+}
+
+// userInfoDecoder decodes UserInfo responses of type `application/jwt`.
+type userInfoDecoder struct {
+	issuer        string
+	clientID      string
+	keys          keySource
+	decryptionKey *key.PrivateKey
+}
+
+// decode verifies and, if encrypted, decrypts the UserInfo response `body` and returns its JSON claims.
+func (d *userInfoDecoder) decode(ctx context.Context, body []byte) ([]byte, error) {
+	token := strings.TrimSpace(string(body))
+
+	if isJWE(token) {
+		if d.decryptionKey == nil {
+			return nil, newError(ErrUserInfo, errors.New("encrypted response, but no decryption key configured"))
+		}
+		plaintext, err := decryptJWE(token, d.decryptionKey)
+		if err != nil {
+			return nil, newError(ErrUserInfo, err)
+		}
+		// The response may be encrypted only, without being signed.
+		token = strings.TrimSpace(string(plaintext))
+		if strings.HasPrefix(token, "{") {
+			return plaintext, nil
+		}
+	}
+
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		return nil, newError(ErrMalformedToken, err)
+	}
+	if err = verifySignature(ctx, jwt, d.keys); err != nil {
+		return nil, err
+	}
+	claims, err := jwt.Claims()
+	if err != nil {
+		return nil, newError(ErrMalformedToken, err)
+	}
+
+	// The signed response SHOULD contain `iss` and `aud` (OIDC Core 5.3.2), so check them if present.
+	if iss, ok, _ := claims.StringClaim("iss"); ok && iss != d.issuer {
+		return nil, newError(ErrInvalidIssuer, fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", d.issuer, iss))
+	}
+	if _, ok := claims["aud"]; ok && !hasAudience(claims, d.clientID) {
+		return nil, newError(ErrInvalidAudience, fmt.Errorf("invalid claim value: 'aud'. client_id=%s not found", d.clientID))
+	}
+
+	return jwt.Payload, nil
+}
+
+// hasAudience reports whether `aud` claim of `claims` contains `clientID`.
+func hasAudience(claims jose.Claims, clientID string) bool {
+	if aud, ok, err := claims.StringClaim("aud"); err == nil && ok {
+		return aud == clientID
+	}
+	auds, _, _ := claims.StringsClaim("aud")
+	for _, aud := range auds {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// UserInfoError is returned when the UserInfo endpoint responds with an error status.
+// It matches ErrUserInfo with errors.Is and ErrProviderUnavailable as well for server errors.
+type UserInfoError struct {
+	StatusCode  int    // HTTP status code of the response.
+	Code        string // Bearer token error code from the `WWW-Authenticate` header, e.g. BearerErrorInvalidToken.
+	Description string // Bearer token error description from the `WWW-Authenticate` header.
+	Scope       string // Scope required to access the UserInfo from the `WWW-Authenticate` header.
+}
+
+func (e *UserInfoError) Error() string {
+	msg := fmt.Sprintf("user info request failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// Is reports whether `target` is ErrUserInfo, or ErrProviderUnavailable in case of server error.
+func (e *UserInfoError) Is(target error) bool {
+	return target == ErrUserInfo || (target == ErrProviderUnavailable && e.StatusCode >= 500)
+}
+
+// SubjectMismatchError is returned when the `sub` claim of the UserInfo response
+// doesn't match the `sub` claim of the ID token. It matches ErrSubjectMismatch with errors.Is.
+type SubjectMismatchError struct {
+	Expected string // Subject of the ID token.
+	Actual   string // Subject of the UserInfo response.
+}
+
+func (e *SubjectMismatchError) Error() string {
+	return fmt.Sprintf("invalid claim value: 'sub'. expected=%s, found=%s", e.Expected, e.Actual)
+}
+
+// Is reports whether `target` is ErrSubjectMismatch.
+func (e *SubjectMismatchError) Is(target error) bool {
+	return target == ErrSubjectMismatch
+}
+
+// verifySubject checks that `ui` belongs to subject `sub`.
+func verifySubject(ui UserInfo, sub string) error {
+	if ui.UserID != sub {
+		return &SubjectMismatchError{Expected: sub, Actual: ui.UserID}
+	}
+	return nil
+}
+
+// newUserInfoError creates a `UserInfoError` from the error response `resp`.
+func newUserInfoError(resp *http.Response) *UserInfoError {
+	e := &UserInfoError{StatusCode: resp.StatusCode}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if strings.EqualFold(scheme, "Bearer") {
+		e.Code = params["error"]
+		e.Description = params["error_description"]
+		e.Scope = params["scope"]
+	}
+	return e
+}
+
+// readUserInfoResponse checks the status of the UserInfo response
+// and returns its media type and body, limited to MaxUserInfoSize.
+func readUserInfoResponse(resp *http.Response) (string, []byte, error) {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", nil, newUserInfoError(resp)
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, newError(ErrUserInfo, fmt.Errorf("invalid content type: %v", err))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxUserInfoSize+1))
+	if err != nil {
+		return "", nil, newError(ErrProviderUnavailable, err)
+	}
+	if len(body) > MaxUserInfoSize {
+		return "", nil, newError(ErrUserInfo, fmt.Errorf("response exceeds %d bytes", MaxUserInfoSize))
+	}
+
+	return contentType, body, nil
+}
+
+// parseChallenge parses a single challenge of a `WWW-Authenticate` header (RFC 7235)
+// into the auth scheme and its parameters.
+func parseChallenge(h string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+
+	h = strings.TrimSpace(h)
+	i := strings.IndexAny(h, " \t")
+	if i < 0 {
+		return h, params
+	}
+	scheme, h = h[:i], h[i:]
+
+	for {
+		h = strings.TrimLeft(h, " \t,")
+		eq := strings.IndexByte(h, '=')
+		if eq < 0 {
+			return scheme, params
+		}
+		name := strings.ToLower(strings.TrimSpace(h[:eq]))
+		h = strings.TrimLeft(h[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(h, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(h) && h[i] != '"'; i++ {
+				if h[i] == '\\' && i+1 < len(h) {
+					i++
+				}
+				b.WriteByte(h[i])
+			}
+			if i < len(h) {
+				i++
+			}
+			value, h = b.String(), h[i:]
+		} else {
+			end := strings.IndexByte(h, ',')
+			if end < 0 {
+				end = len(h)
+			}
+			value, h = strings.TrimSpace(h[:end]), h[end:]
+		}
+		params[name] = value
+	}
+}
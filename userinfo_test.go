@@ -0,0 +1,349 @@
+package maas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/key"
+)
+
+func TestGetUserInfoErrorStatus(t *testing.T) {
+	resp := newTestResponse(401, "text/html", "<html>Unauthorized</html>")
+	resp.Header.Set("WWW-Authenticate", `Bearer realm="example", error="invalid_token", error_description="The access token \"expired\""`)
+	d := &testDoer{Response: resp}
+
+	_, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, nil)
+
+	var uerr *UserInfoError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("Expected UserInfoError, got %v", err)
+	}
+	if uerr.StatusCode != 401 || uerr.Code != BearerErrorInvalidToken || uerr.Description != `The access token "expired"` {
+		t.Errorf("Wrong error %+v", uerr)
+	}
+	if !errors.Is(err, ErrUserInfo) {
+		t.Error("Error is not ErrUserInfo")
+	}
+	if errors.Is(err, ErrProviderUnavailable) {
+		t.Error("Client error is ErrProviderUnavailable")
+	}
+}
+
+func TestGetUserInfoInsufficientScope(t *testing.T) {
+	resp := newTestResponse(403, "application/json", "{}")
+	resp.Header.Set("WWW-Authenticate", `Bearer error=insufficient_scope, scope="openid email"`)
+	d := &testDoer{Response: resp}
+
+	_, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, nil)
+
+	var uerr *UserInfoError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("Expected UserInfoError, got %v", err)
+	}
+	if uerr.StatusCode != 403 || uerr.Code != BearerErrorInsufficientScope || uerr.Scope != "openid email" {
+		t.Errorf("Wrong error %+v", uerr)
+	}
+}
+
+func TestGetUserInfoServerError(t *testing.T) {
+	d := &testDoer{Response: newTestResponse(503, "text/plain", "unavailable")}
+
+	_, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, nil)
+
+	var uerr *UserInfoError
+	if !errors.As(err, &uerr) || uerr.StatusCode != 503 {
+		t.Fatalf("Expected UserInfoError, got %v", err)
+	}
+	if !errors.Is(err, ErrProviderUnavailable) {
+		t.Error("Server error is not ErrProviderUnavailable")
+	}
+}
+
+func TestGetUserInfoInvalidResponse(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		body        string
+	}{
+		"html":        {"text/html", "<html></html>"},
+		"no type":     {"", `{"sub":"test"}`},
+		"empty":       {"application/json", "{}"},
+		"invalid":     {"application/json", "{"},
+		"over limit":  {"application/json", `{"sub":"test","x":"` + strings.Repeat("x", MaxUserInfoSize) + `"}`},
+		"wrong types": {"application/json", `{"sub":1}`},
+	}
+
+	for name, c := range cases {
+		d := &testDoer{Response: newTestResponse(200, c.contentType, c.body)}
+
+		_, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, nil)
+		if !errors.Is(err, ErrUserInfo) {
+			t.Errorf("%v: expected ErrUserInfo, got %v", name, err)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	cases := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{"", "", map[string]string{}},
+		{"Bearer", "Bearer", map[string]string{}},
+		{`Bearer realm="example"`, "Bearer", map[string]string{"realm": "example"}},
+		{
+			`Bearer realm="a, b", error=invalid_token,error_description="say \"hi\""`,
+			"Bearer",
+			map[string]string{"realm": "a, b", "error": "invalid_token", "error_description": `say "hi"`},
+		},
+		{`bearer Error="invalid_request"`, "bearer", map[string]string{"error": "invalid_request"}},
+		{`Bearer error="unterminated`, "Bearer", map[string]string{"error": "unterminated"}},
+	}
+
+	for _, c := range cases {
+		scheme, params := parseChallenge(c.header)
+		if scheme != c.scheme {
+			t.Errorf("%q: wrong scheme %q", c.header, scheme)
+		}
+		if len(params) != len(c.params) {
+			t.Errorf("%q: wrong params %v", c.header, params)
+		}
+		for k, v := range c.params {
+			if params[k] != v {
+				t.Errorf("%q: wrong param %v=%q", c.header, k, params[k])
+			}
+		}
+	}
+}
+
+func TestGetUserInfoForToken(t *testing.T) {
+	tkn := Token{AccessToken: "test-access-token", Claims: jose.Claims{"sub": "test"}}
+	d := &testDoer{Response: newTestResponse(200, "application/json", `{"sub":"test","email":"test@example.net"}`)}
+
+	ui, claims, err := getUserInfoForToken(context.Background(), "test-endpoint", tkn, d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ui.UserID != "test" || ui.Email != "test@example.net" {
+		t.Errorf("Wrong user info %+v", ui)
+	}
+	if v, _, _ := claims.StringClaim("email"); v != "test@example.net" {
+		t.Errorf("Wrong claims %v", claims)
+	}
+	if d.Request.Header.Get("Authorization") != "Bearer test-access-token" {
+		t.Error("Wrong authorization header sent")
+	}
+}
+
+func TestGetUserInfoForTokenSubjectMismatch(t *testing.T) {
+	tkn := Token{AccessToken: "test-access-token", Claims: jose.Claims{"sub": "test"}}
+	d := &testDoer{Response: newTestResponse(200, "application/json", `{"sub":"other","email":"other@example.net"}`)}
+
+	ui, claims, err := getUserInfoForToken(context.Background(), "test-endpoint", tkn, d, nil)
+
+	var serr *SubjectMismatchError
+	if !errors.As(err, &serr) || serr.Expected != "test" || serr.Actual != "other" {
+		t.Fatalf("Expected SubjectMismatchError, got %#v", err)
+	}
+	if !errors.Is(err, ErrSubjectMismatch) {
+		t.Error("Error is not ErrSubjectMismatch")
+	}
+	if ui.UserID != "" || claims != nil {
+		t.Error("User info returned on subject mismatch")
+	}
+}
+
+func TestGetUserInfoForTokenWithoutIDToken(t *testing.T) {
+	d := &testDoer{}
+
+	_, _, err := getUserInfoForToken(context.Background(), "test-endpoint", Token{AccessToken: "test-access-token"}, d, nil)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+	if d.Request != nil {
+		t.Error("Request sent without ID token")
+	}
+}
+
+func TestUserInfoStandardClaims(t *testing.T) {
+	body := `{
+		"sub": "test",
+		"name": "Jane Doe",
+		"given_name": "Jane",
+		"family_name": "Doe",
+		"email": "jane@example.net",
+		"email_verified": true,
+		"locale": "en-GB",
+		"phone_number": "+44 20 7946 0000",
+		"phone_number_verified": false,
+		"address": {"locality": "London", "country": "UK"},
+		"updated_at": 1311280970,
+		"custom": "value",
+		"roles": ["admin", "user"],
+		"level": 3,
+		"active": true
+	}`
+	d := &testDoer{Response: newTestResponse(200, "application/json", body)}
+
+	ui, claims, err := getUserInfoClaims(context.Background(), "test-endpoint", "test-access-token", d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ui.UserID != "test" || ui.Name != "Jane Doe" || ui.GivenName != "Jane" || ui.FamilyName != "Doe" {
+		t.Errorf("Wrong names %+v", ui)
+	}
+	if ui.Email != "jane@example.net" || !ui.EmailVerified {
+		t.Errorf("Wrong email %+v", ui)
+	}
+	if ui.Locale != "en-GB" || ui.PhoneNumber != "+44 20 7946 0000" || ui.PhoneNumberVerified {
+		t.Errorf("Wrong locale or phone number %+v", ui)
+	}
+	if ui.Address == nil || ui.Address.Locality != "London" || ui.Address.Country != "UK" {
+		t.Errorf("Wrong address %+v", ui.Address)
+	}
+	if !ui.UpdatedAt.Equal(time.Unix(1311280970, 0)) {
+		t.Errorf("Wrong update time %v", ui.UpdatedAt)
+	}
+
+	if v, ok, err := claims.StringClaim("custom"); err != nil || !ok || v != "value" {
+		t.Errorf("Wrong custom claim %v %v %v", v, ok, err)
+	}
+	if v, ok, err := claims.StringsClaim("roles"); err != nil || !ok || !reflect.DeepEqual(v, []string{"admin", "user"}) {
+		t.Errorf("Wrong roles claim %v %v %v", v, ok, err)
+	}
+	if v, ok, err := claims.Int64Claim("level"); err != nil || !ok || v != 3 {
+		t.Errorf("Wrong level claim %v %v %v", v, ok, err)
+	}
+	if v, ok, err := claims.BoolClaim("active"); err != nil || !ok || !v {
+		t.Errorf("Wrong active claim %v %v %v", v, ok, err)
+	}
+	if _, _, err := claims.BoolClaim("custom"); err == nil {
+		t.Error("String claim parsed as bool")
+	}
+	if _, ok, err := claims.StringClaim("missing"); err != nil || ok {
+		t.Error("Missing claim found")
+	}
+}
+
+func TestUserInfoMarshalJSON(t *testing.T) {
+	ui := UserInfo{
+		UserID:    "test",
+		Email:     "test@example.net",
+		Address:   &Address{Country: "UK"},
+		UpdatedAt: time.Unix(1311280970, 0),
+	}
+
+	data, err := json.Marshal(ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded UserInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.UserID != ui.UserID || decoded.Email != ui.Email || !decoded.UpdatedAt.Equal(ui.UpdatedAt) {
+		t.Errorf("Wrong user info decoded %+v", decoded)
+	}
+	if !reflect.DeepEqual(decoded.Address, ui.Address) {
+		t.Errorf("Wrong address decoded %+v", decoded.Address)
+	}
+	var claims UserInfoClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := claims.Int64Claim("updated_at"); v != 1311280970 {
+		t.Errorf("Wrong updated_at claim %v", v)
+	}
+}
+
+func newTestUserInfoDecoder(k *key.PrivateKey, decryptionKey *key.PrivateKey) *userInfoDecoder {
+	return &userInfoDecoder{
+		issuer:        "https://issuer",
+		clientID:      "test-id",
+		keys:          &testKeySource{PublicKeys: []key.PublicKey{*key.NewPublicKey(k.JWK())}},
+		decryptionKey: decryptionKey,
+	}
+}
+
+func TestGetUserInfoSigned(t *testing.T) {
+	k := newTestPrivateKey(t)
+	jwt := newTestSignedJWT(t, k, jose.Claims{"iss": "https://issuer", "aud": "test-id", "sub": "test", "email": "test@example.net"})
+	d := &testDoer{Response: newTestResponse(200, "application/jwt", jwt.Encode())}
+
+	ui, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, newTestUserInfoDecoder(k, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ui.UserID != "test" || ui.Email != "test@example.net" {
+		t.Errorf("Wrong user info %+v", ui)
+	}
+}
+
+func TestGetUserInfoSignedInvalid(t *testing.T) {
+	k := newTestPrivateKey(t)
+	other := newTestPrivateKey(t)
+
+	cases := map[string]struct {
+		jwt  jose.JWT
+		kind error
+	}{
+		"signature": {newTestSignedJWT(t, other, jose.Claims{"sub": "test"}), ErrInvalidSignature},
+		"issuer":    {newTestSignedJWT(t, k, jose.Claims{"iss": "https://other", "sub": "test"}), ErrInvalidIssuer},
+		"audience":  {newTestSignedJWT(t, k, jose.Claims{"aud": []string{"other-id"}, "sub": "test"}), ErrInvalidAudience},
+	}
+
+	for name, c := range cases {
+		d := &testDoer{Response: newTestResponse(200, "application/jwt", c.jwt.Encode())}
+
+		_, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, newTestUserInfoDecoder(k, nil))
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%v: expected %v, got %v", name, c.kind, err)
+		}
+	}
+
+	d := &testDoer{Response: newTestResponse(200, "application/jwt", "not-a-jwt")}
+	if _, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, newTestUserInfoDecoder(k, nil)); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("Expected ErrMalformedToken, got %v", err)
+	}
+}
+
+func TestGetUserInfoEncrypted(t *testing.T) {
+	k := newTestPrivateKey(t)
+	clientKey := newTestPrivateKey(t)
+	jwt := newTestSignedJWT(t, k, jose.Claims{"iss": "https://issuer", "aud": "test-id", "sub": "test"})
+
+	cases := map[string][]byte{
+		"signed":   []byte(jwt.Encode()),
+		"unsigned": []byte(`{"sub":"test","email":"a.b@example.net"}`),
+	}
+
+	for name, plaintext := range cases {
+		d := &testDoer{Response: newTestResponse(200, "application/jwt", encryptJWE(t, clientKey, encA128CBCHS256, plaintext))}
+
+		ui, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, newTestUserInfoDecoder(k, clientKey))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if ui.UserID != "test" {
+			t.Errorf("%v: wrong user info %+v", name, ui)
+		}
+	}
+}
+
+func TestGetUserInfoEncryptedWithoutKey(t *testing.T) {
+	k := newTestPrivateKey(t)
+	d := &testDoer{Response: newTestResponse(200, "application/jwt", encryptJWE(t, k, encA128GCM, []byte(`{"sub":"test"}`)))}
+
+	if _, err := getUserInfo(context.Background(), "test-endpoint", "test-access-token", d, newTestUserInfoDecoder(k, nil)); !errors.Is(err, ErrUserInfo) {
+		t.Errorf("Expected ErrUserInfo, got %v", err)
+	}
+}